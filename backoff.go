@@ -0,0 +1,93 @@
+package graphql
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff decides how long the subscription client waits between connection attempts.
+type Backoff interface {
+	// NextDelay returns the delay before the next connection attempt.
+	// attempt is the number of consecutive failed attempts, starting at 1,
+	// and elapsed is the time since the first failed attempt.
+	// It returns false if the client should stop retrying.
+	NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// BackoffFunc is an adapter to allow the use of ordinary functions as Backoff.
+type BackoffFunc func(attempt int, elapsed time.Duration) (time.Duration, bool)
+
+// NextDelay calls f(attempt, elapsed).
+func (f BackoffFunc) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	return f(attempt, elapsed)
+}
+
+// ConstantBackoff retries at a fixed interval.
+// The client gives up after MaxAttempts failed attempts or MaxElapsedTime since the first failure.
+// Zero MaxAttempts and MaxElapsedTime mean retrying forever.
+type ConstantBackoff struct {
+	Interval       time.Duration
+	MaxAttempts    int
+	MaxElapsedTime time.Duration
+}
+
+// NextDelay implements Backoff.
+func (b ConstantBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if exhausted(attempt, b.MaxAttempts, elapsed, b.MaxElapsedTime) {
+		return 0, false
+	}
+	return b.Interval, true
+}
+
+// ExponentialBackoff multiplies the delay after every failed attempt, up to MaxInterval.
+// The client gives up after MaxAttempts failed attempts or MaxElapsedTime since the first failure.
+// Zero MaxAttempts and MaxElapsedTime mean retrying forever.
+type ExponentialBackoff struct {
+	// InitialInterval is the delay after the first failed attempt. Default 1 second
+	InitialInterval time.Duration
+	// MaxInterval caps the delay. Zero means no limit
+	MaxInterval time.Duration
+	// Multiplier grows the delay after every attempt. Default 2
+	Multiplier float64
+	// Jitter randomizes the delay by up to the given fraction, e.g. 0.5 gives a delay between 50% and 150% of the computed value
+	Jitter         float64
+	MaxAttempts    int
+	MaxElapsedTime time.Duration
+}
+
+// NextDelay implements Backoff.
+func (b ExponentialBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if exhausted(attempt, b.MaxAttempts, elapsed, b.MaxElapsedTime) {
+		return 0, false
+	}
+	initial := b.InitialInterval
+	if initial <= 0 {
+		initial = time.Second
+	}
+	multiplier := b.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	delay := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if b.MaxInterval > 0 && delay > float64(b.MaxInterval) {
+		delay = float64(b.MaxInterval)
+	}
+	// guard against overflow when the delay isn't capped
+	if delay > math.MaxInt64 {
+		delay = math.MaxInt64
+	}
+	return time.Duration(delay), true
+}
+
+// exhausted reports whether the attempt or elapsed time limits, if any, are reached.
+func exhausted(attempt, maxAttempts int, elapsed, maxElapsedTime time.Duration) bool {
+	if maxAttempts > 0 && attempt >= maxAttempts {
+		return true
+	}
+	return maxElapsedTime > 0 && elapsed > maxElapsedTime
+}
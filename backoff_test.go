@@ -0,0 +1,62 @@
+package graphql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+		MaxAttempts:     6,
+	}
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+	}
+	for i, w := range want {
+		got, ok := b.NextDelay(i+1, 0)
+		if !ok {
+			t.Fatalf("attempt %d: got ok: false, want: true", i+1)
+		}
+		if got != w {
+			t.Errorf("attempt %d: got delay: %v, want: %v", i+1, got, w)
+		}
+	}
+	if _, ok := b.NextDelay(6, 0); ok {
+		t.Error("got ok: true after max attempts, want: false")
+	}
+}
+
+func TestExponentialBackoff_jitter(t *testing.T) {
+	b := ExponentialBackoff{
+		InitialInterval: time.Second,
+		Jitter:          0.5,
+	}
+	for i := 0; i < 100; i++ {
+		got, _ := b.NextDelay(2, 0)
+		if got < time.Second || got > 3*time.Second {
+			t.Fatalf("got delay: %v, want between 1s and 3s", got)
+		}
+	}
+}
+
+func TestConstantBackoff(t *testing.T) {
+	b := ConstantBackoff{
+		Interval:       time.Second,
+		MaxElapsedTime: time.Minute,
+	}
+	if got, ok := b.NextDelay(100, 30*time.Second); !ok || got != time.Second {
+		t.Errorf("got delay: %v, %v, want: 1s, true", got, ok)
+	}
+	if _, ok := b.NextDelay(100, 2*time.Minute); ok {
+		t.Error("got ok: true after max elapsed time, want: false")
+	}
+	if _, ok := (ConstantBackoff{}).NextDelay(1000000, 24*time.Hour); !ok {
+		t.Error("got ok: false for unlimited backoff, want: true")
+	}
+}
@@ -0,0 +1,414 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/machship-mm/go-graphql-client/internal/jsonutil"
+)
+
+// Selection is an element of a selection set built at runtime: a field, a fragment spread or an inline fragment.
+type Selection interface {
+	writeSelection(w io.Writer) error
+}
+
+// Var refers to an operation variable in an argument. E.g., Var("id") -> $id.
+type Var string
+
+// Enum is an enum value argument, written without quotes. E.g., Enum("ACTIVE") -> ACTIVE.
+type Enum string
+
+// Field is a field built at runtime.
+type Field struct {
+	name       string
+	alias      string
+	args       []argument
+	directives []string
+	selections []Selection
+}
+
+type argument struct {
+	name  string
+	value interface{}
+}
+
+// NewField creates a field with an optional selection set.
+func NewField(name string, selections ...Selection) *Field {
+	return &Field{name: name, selections: selections}
+}
+
+// Alias sets the response key of the field.
+func (f *Field) Alias(alias string) *Field {
+	f.alias = alias
+	return f
+}
+
+// Arg adds an argument. The value is a Var, an Enum, or a Go value written as a GraphQL literal.
+func (f *Field) Arg(name string, value interface{}) *Field {
+	f.args = append(f.args, argument{name: name, value: value})
+	return f
+}
+
+// Directive adds a directive, written verbatim. E.g., "@include(if: $withDetails)".
+func (f *Field) Directive(directive string) *Field {
+	f.directives = append(f.directives, directive)
+	return f
+}
+
+// Select adds fields or fragments to the selection set.
+func (f *Field) Select(selections ...Selection) *Field {
+	f.selections = append(f.selections, selections...)
+	return f
+}
+
+func (f *Field) writeSelection(w io.Writer) error {
+	if f.alias != "" {
+		io.WriteString(w, f.alias+":")
+	}
+	io.WriteString(w, f.name)
+	if len(f.args) > 0 {
+		io.WriteString(w, "(")
+		for i, arg := range f.args {
+			if i != 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, arg.name+":")
+			if err := writeValue(w, arg.value); err != nil {
+				return fmt.Errorf("graphql: argument %s of field %s: %w", arg.name, f.name, err)
+			}
+		}
+		io.WriteString(w, ")")
+	}
+	for _, directive := range f.directives {
+		io.WriteString(w, " "+directive)
+	}
+	return writeSelectionSet(w, f.selections)
+}
+
+type fragmentSpread string
+
+func (s fragmentSpread) writeSelection(w io.Writer) error {
+	_, err := io.WriteString(w, "..."+string(s))
+	return err
+}
+
+// Spread creates a spread of the named fragment. E.g., Spread("UserFields") -> ...UserFields.
+func Spread(name string) Selection {
+	return fragmentSpread(name)
+}
+
+type inlineFragment struct {
+	on         string
+	selections []Selection
+}
+
+func (f inlineFragment) writeSelection(w io.Writer) error {
+	io.WriteString(w, "... on "+f.on)
+	return writeSelectionSet(w, f.selections)
+}
+
+// On creates an inline fragment on the type. E.g., On("User", NewField("name")) -> ... on User{name}.
+func On(typeCondition string, selections ...Selection) Selection {
+	return inlineFragment{on: typeCondition, selections: selections}
+}
+
+func writeSelectionSet(w io.Writer, selections []Selection) error {
+	if len(selections) == 0 {
+		return nil
+	}
+	io.WriteString(w, "{")
+	for i, s := range selections {
+		if i != 0 {
+			io.WriteString(w, ",")
+		}
+		if err := s.writeSelection(w); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}")
+	return err
+}
+
+// writeValue writes v as a GraphQL literal.
+// Structs and json.Marshaler values are written as their JSON encoding, with unquoted object keys.
+func writeValue(w io.Writer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		_, err := io.WriteString(w, "null")
+		return err
+	case Var:
+		_, err := io.WriteString(w, "$"+string(v))
+		return err
+	case Enum:
+		_, err := io.WriteString(w, string(v))
+		return err
+	case json.Number:
+		_, err := io.WriteString(w, string(v))
+		return err
+	case json.Marshaler:
+		// scalars such as GqlString
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+			_, err := io.WriteString(w, "null")
+			return err
+		}
+		b, err := v.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return writeJSONValue(w, b)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			_, err := io.WriteString(w, "null")
+			return err
+		}
+		return writeValue(w, rv.Elem().Interface())
+	case reflect.String:
+		return writeString(w, rv.String())
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		_, err := fmt.Fprint(w, v)
+		return err
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("unsupported value %v", f)
+		}
+		_, err := io.WriteString(w, strconv.FormatFloat(rv.Float(), 'g', -1, rv.Type().Bits()))
+		return err
+	case reflect.Slice, reflect.Array:
+		io.WriteString(w, "[")
+		for i := 0; i < rv.Len(); i++ {
+			if i != 0 {
+				io.WriteString(w, ",")
+			}
+			if err := writeValue(w, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "]")
+		return err
+	case reflect.Map:
+		// Sort keys in order to produce deterministic output.
+		keys := make([]string, 0, rv.Len())
+		values := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			key := fmt.Sprint(k.Interface())
+			if !isName(key) {
+				return fmt.Errorf("invalid object field name %q", key)
+			}
+			keys = append(keys, key)
+			values[key] = rv.MapIndex(k).Interface()
+		}
+		sort.Strings(keys)
+		io.WriteString(w, "{")
+		for i, k := range keys {
+			if i != 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, k+":")
+			if err := writeValue(w, values[k]); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "}")
+		return err
+	case reflect.Struct:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return writeJSONValue(w, b)
+	}
+	return fmt.Errorf("unsupported value of type %T", v)
+}
+
+// writeJSONValue writes the JSON encoded value b as a GraphQL literal.
+func writeJSONValue(w io.Writer, b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	return writeValue(w, v)
+}
+
+// writeString writes s as a GraphQL string, whose escape sequences are the ones of JSON.
+func writeString(w io.Writer, s string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	_, err := w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return err
+}
+
+// isName reports whether s is a GraphQL name, e.g. an object field name.
+func isName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] == '_' || 'a' <= s[i] && s[i] <= 'z' || 'A' <= s[i] && s[i] <= 'Z' || i > 0 && '0' <= s[i] && s[i] <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Operation is a query, mutation or subscription built at runtime.
+//
+// E.g.,
+//
+//	op := graphql.NewQuery(
+//		graphql.NewField("user", graphql.NewField("name")).Arg("id", graphql.Var("id")),
+//	).Name("GetUser").Var("id", graphql.NewStringStruct("1"))
+type Operation struct {
+	keyword    string
+	name       string
+	variables  map[string]interface{}
+	selections []Selection
+	fragments  []fragmentDefinition
+}
+
+type fragmentDefinition struct {
+	name       string
+	on         string
+	selections []Selection
+}
+
+// NewQuery creates a query with the selection set.
+func NewQuery(selections ...Selection) *Operation {
+	return &Operation{keyword: "query", selections: selections}
+}
+
+// NewMutation creates a mutation with the selection set.
+func NewMutation(selections ...Selection) *Operation {
+	return &Operation{keyword: "mutation", selections: selections}
+}
+
+// NewSubscription creates a subscription with the selection set.
+func NewSubscription(selections ...Selection) *Operation {
+	return &Operation{keyword: "subscription", selections: selections}
+}
+
+// Name sets the operation name.
+func (o *Operation) Name(name string) *Operation {
+	o.name = name
+	return o
+}
+
+// Select adds fields or fragments to the selection set.
+func (o *Operation) Select(selections ...Selection) *Operation {
+	o.selections = append(o.selections, selections...)
+	return o
+}
+
+// Var adds a variable. Its type is derived from the Go type of value, like for struct operations.
+func (o *Operation) Var(name string, value interface{}) *Operation {
+	if o.variables == nil {
+		o.variables = make(map[string]interface{})
+	}
+	o.variables[name] = value
+	return o
+}
+
+// TypedVar adds a variable with an explicit GraphQL type. E.g., TypedVar("id", "ID!", "0x1").
+func (o *Operation) TypedVar(name string, graphqlType string, value interface{}) *Operation {
+	return o.Var(name, typedVariable{graphqlType: graphqlType, value: value})
+}
+
+// Fragment adds a named fragment definition. Use Spread to refer to it.
+func (o *Operation) Fragment(name string, on string, selections ...Selection) *Operation {
+	o.fragments = append(o.fragments, fragmentDefinition{name: name, on: on, selections: selections})
+	return o
+}
+
+// Variables returns the variables of the operation.
+func (o *Operation) Variables() map[string]interface{} {
+	return o.variables
+}
+
+// Build returns the minified operation, as sent to the server.
+// It fails if the GraphQL type of a variable can't be derived from its Go type,
+// or an argument value can't be written as a GraphQL literal.
+func (o *Operation) Build() (string, error) {
+	var buf bytes.Buffer
+	if len(o.variables) > 0 || o.name != "" || o.keyword != "query" {
+		buf.WriteString(o.keyword)
+		if o.name != "" || len(o.variables) > 0 {
+			buf.WriteString(" " + o.name)
+		}
+	}
+	if len(o.variables) > 0 {
+		arguments, err := queryArguments(o.variables)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString("(" + arguments + ")")
+	}
+	if err := writeSelectionSet(&buf, o.selections); err != nil {
+		return "", err
+	}
+	for _, f := range o.fragments {
+		buf.WriteString("fragment " + f.name + " on " + f.on)
+		if err := writeSelectionSet(&buf, f.selections); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// String returns the minified operation, or the error message if it can't be built.
+func (o *Operation) String() string {
+	query, err := o.Build()
+	if err != nil {
+		return err.Error()
+	}
+	return query
+}
+
+// Exec executes an operation built at runtime, populating the response data into v.
+// v is a pointer to map[string]interface{}, or to a struct that corresponds to the selection set.
+func (c *Client) Exec(ctx context.Context, op *Operation, v interface{}) error {
+	query, err := op.Build()
+	if err == nil {
+		err = c.validate(query, nil)
+	}
+	if err != nil {
+		return err
+	}
+	data, err := c.request(ctx, query, op.Variables())
+	if data != nil {
+		if m, ok := v.(*map[string]interface{}); ok {
+			if err := json.Unmarshal(*data, m); err != nil {
+				return err
+			}
+		} else if err := jsonutil.UnmarshalGraphQL(*data, v); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// ExecRaw executes an operation built at runtime.
+// return raw bytes message.
+func (c *Client) ExecRaw(ctx context.Context, op *Operation) (*json.RawMessage, error) {
+	query, err := op.Build()
+	if err == nil {
+		err = c.validate(query, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.request(ctx, query, op.Variables())
+}
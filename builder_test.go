@@ -0,0 +1,163 @@
+package graphql_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"testing"
+
+	graphql "github.com/machship-mm/go-graphql-client"
+)
+
+func TestOperation_String(t *testing.T) {
+	tests := []struct {
+		op   *graphql.Operation
+		want string
+	}{
+		{
+			op:   graphql.NewQuery(graphql.NewField("viewer", graphql.NewField("login"), graphql.NewField("createdAt"))),
+			want: `{viewer{login,createdAt}}`,
+		},
+		{
+			op: graphql.NewQuery(
+				graphql.NewField("repository",
+					graphql.NewField("issue", graphql.NewField("body")).Arg("number", graphql.Var("issueNumber")),
+				).Arg("owner", graphql.Var("repositoryOwner")).Arg("name", graphql.Var("repositoryName")),
+			).TypedVar("repositoryOwner", "String!", "shurcooL-test").
+				TypedVar("repositoryName", "String!", "test-repo").
+				TypedVar("issueNumber", "Int!", 1).
+				Var("withBody", graphql.NewBoolStruct(true)),
+			want: `query ($issueNumber:Int!$repositoryName:String!$repositoryOwner:String!$withBody:Boolean!){repository(owner:$repositoryOwner,name:$repositoryName){issue(number:$issueNumber){body}}}`,
+		},
+		{
+			op: graphql.NewQuery(
+				graphql.NewField("users",
+					graphql.NewField("name"),
+					graphql.NewField("email").Directive("@include(if: $withEmail)"),
+				).Arg("first", 10).Arg("status", graphql.Enum("ACTIVE")).Arg("filter", map[string]interface{}{"name": "Ada", "tags": []string{"a", "b"}}),
+			).Name("ListUsers").TypedVar("withEmail", "Boolean!", true),
+			want: `query ListUsers($withEmail:Boolean!){users(first:10,status:ACTIVE,filter:{name:"Ada",tags:["a","b"]}){name,email @include(if: $withEmail)}}`,
+		},
+		{
+			op: graphql.NewQuery(
+				graphql.NewField("viewer", graphql.Spread("UserFields")),
+				graphql.NewField("node",
+					graphql.On("User", graphql.NewField("login")),
+				).Arg("id", "1").Alias("first"),
+			).Fragment("UserFields", "User", graphql.NewField("name"), graphql.NewField("email")),
+			want: `{viewer{...UserFields},first:node(id:"1"){... on User{login}}}fragment UserFields on User{name,email}`,
+		},
+		{
+			op: graphql.NewMutation(
+				graphql.NewField("addReaction", graphql.NewField("subject", graphql.NewField("id"))).Arg("input", graphql.Var("input")),
+			).TypedVar("input", "AddReactionInput!", map[string]interface{}{"subjectId": "1"}),
+			want: `mutation ($input:AddReactionInput!){addReaction(input:$input){subject{id}}}`,
+		},
+		{
+			op: graphql.NewQuery(
+				graphql.NewField("u").Arg("s", "a\x01b\"<").
+					Arg("st", struct {
+						Name string `json:"name"`
+						Age  int    `json:"age"`
+					}{"Ada", 1}).
+					Arg("raw", json.RawMessage(`{"b": null, "a": [1, "x", 1.5]}`)).
+					Arg("f", 0.5),
+			),
+			want: `{u(s:"a\u0001b\"<",st:{age:1,name:"Ada"},raw:{a:[1,"x",1.5],b:null},f:0.5)}`,
+		},
+		{
+			op:   graphql.NewSubscription(graphql.NewField("helloSaid", graphql.NewField("msg"))).Name("OnHello"),
+			want: `subscription OnHello{helloSaid{msg}}`,
+		},
+	}
+	for i, tc := range tests {
+		if got := tc.op.String(); got != tc.want {
+			t.Errorf("\ntest case %d:\n got: %q\nwant: %q", i, got, tc.want)
+		}
+	}
+}
+
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalJSON() ([]byte, error) { return nil, errors.New("marshal failed") }
+
+func TestOperation_Build_errors(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		wantErr string
+	}{
+		{failingMarshaler{}, "graphql: argument v of field u: marshal failed"},
+		{map[string]int{"a-b": 1}, `graphql: argument v of field u: invalid object field name "a-b"`},
+		{json.RawMessage(`{"a b": 1}`), `graphql: argument v of field u: invalid object field name "a b"`},
+		{math.NaN(), "graphql: argument v of field u: unsupported value NaN"},
+		{make(chan int), "graphql: argument v of field u: unsupported value of type chan int"},
+	}
+	for i, tc := range tests {
+		_, err := graphql.NewQuery(graphql.NewField("u").Arg("v", tc.value)).Build()
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("test case %d: got error: %v, want: %s", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestClient_Exec(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, req *http.Request) {
+		body := mustRead(req.Body)
+		if got, want := body, `{"query":"query ($id:ID!){user(id:$id){name,email}}","variables":{"id":"1"}}`+"\n"; got != want {
+			t.Errorf("got body: %v, want %v", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		mustWrite(w, `{"data": {"user": {"name": "Gopher", "email": "gopher@example.com"}}}`)
+	})
+	client := graphql.NewClient("/graphql", &http.Client{Transport: localRoundTripper{handler: mux}})
+
+	// Fields are only known at runtime.
+	var fields []graphql.Selection
+	for _, name := range []string{"name", "email"} {
+		fields = append(fields, graphql.NewField(name))
+	}
+	op := graphql.NewQuery(graphql.NewField("user", fields...).Arg("id", graphql.Var("id"))).TypedVar("id", "ID!", "1")
+
+	var m map[string]interface{}
+	if err := client.Exec(context.Background(), op, &m); err != nil {
+		t.Fatal(err)
+	}
+	user, _ := m["user"].(map[string]interface{})
+	if got, want := user["email"], "gopher@example.com"; got != want {
+		t.Errorf("got email: %v, want: %v", got, want)
+	}
+
+	var q struct {
+		User struct {
+			Name  string
+			Email string
+		}
+	}
+	if err := client.Exec(context.Background(), op, &q); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := q.User.Name, "Gopher"; got != want {
+		t.Errorf("got name: %q, want: %q", got, want)
+	}
+}
+
+func TestClient_Exec_errors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		mustWrite(w, `{"data": {"user": null}, "errors": [{"message": "user not found"}]}`)
+	})
+	client := graphql.NewClient("/graphql", &http.Client{Transport: localRoundTripper{handler: mux}})
+
+	var m map[string]interface{}
+	err := client.Exec(context.Background(), graphql.NewQuery(graphql.NewField("user", graphql.NewField("name"))), &m)
+	if err == nil || err.Error() != "user not found" {
+		t.Fatalf("got error: %v, want: user not found", err)
+	}
+	if _, ok := m["user"]; !ok {
+		t.Errorf("got %v, want partial data with user key", m)
+	}
+}
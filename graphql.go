@@ -17,6 +17,7 @@ import (
 type Client struct {
 	url        string // GraphQL server URL.
 	httpClient *http.Client
+	schema     *Schema // Validates operations before they're sent, if set.
 }
 
 // NewClient creates a GraphQL client targeting the specified GraphQL server URL.
@@ -31,27 +32,36 @@ func NewClient(url string, httpClient *http.Client) *Client {
 	}
 }
 
+// WithSchema validates the operations against schema before they're sent.
+// Invalid operations fail with ValidationErrors, which point to the Go struct fields responsible.
+func (c *Client) WithSchema(schema *Schema) *Client {
+	c.schema = schema
+	return c
+}
+
 // Query executes a single GraphQL query request,
 // with a query derived from q, populating the response into it.
 // q should be a pointer to struct that corresponds to the GraphQL schema.
-func (c *Client) Query(ctx context.Context, q interface{}, variables map[string]interface{}) error {
+// variables is a map[string]interface{}, or a struct with fields tagged with the variable names and types, e.g. `graphql:"id,type=ID!"`.
+func (c *Client) Query(ctx context.Context, q interface{}, variables interface{}) error {
 	return c.do(ctx, queryOperation, q, variables, "")
 }
 
 // NamedQuery executes a single GraphQL query request, with operation name
-func (c *Client) NamedQuery(ctx context.Context, name string, q interface{}, variables map[string]interface{}) error {
+func (c *Client) NamedQuery(ctx context.Context, name string, q interface{}, variables interface{}) error {
 	return c.do(ctx, queryOperation, q, variables, name)
 }
 
 // Mutate executes a single GraphQL mutation request,
 // with a mutation derived from m, populating the response into it.
 // m should be a pointer to struct that corresponds to the GraphQL schema.
-func (c *Client) Mutate(ctx context.Context, m interface{}, variables map[string]interface{}) error {
+// variables is a map[string]interface{}, or a struct with fields tagged with the variable names and types, e.g. `graphql:"id,type=ID!"`.
+func (c *Client) Mutate(ctx context.Context, m interface{}, variables interface{}) error {
 	return c.do(ctx, mutationOperation, m, variables, "")
 }
 
 // NamedMutate executes a single GraphQL mutation request, with operation name
-func (c *Client) NamedMutate(ctx context.Context, name string, m interface{}, variables map[string]interface{}) error {
+func (c *Client) NamedMutate(ctx context.Context, name string, m interface{}, variables interface{}) error {
 	return c.do(ctx, mutationOperation, m, variables, name)
 }
 
@@ -59,13 +69,13 @@ func (c *Client) NamedMutate(ctx context.Context, name string, m interface{}, va
 // with a query derived from q, populating the response into it.
 // q should be a pointer to struct that corresponds to the GraphQL schema.
 // return raw bytes message.
-func (c *Client) QueryRaw(ctx context.Context, q interface{}, variables map[string]interface{}) (*json.RawMessage, error) {
+func (c *Client) QueryRaw(ctx context.Context, q interface{}, variables interface{}) (*json.RawMessage, error) {
 	return c.doRaw(ctx, queryOperation, q, variables, "")
 }
 
 // NamedQueryRaw executes a single GraphQL query request, with operation name
 // return raw bytes message.
-func (c *Client) NamedQueryRaw(ctx context.Context, name string, q interface{}, variables map[string]interface{}) (*json.RawMessage, error) {
+func (c *Client) NamedQueryRaw(ctx context.Context, name string, q interface{}, variables interface{}) (*json.RawMessage, error) {
 	return c.doRaw(ctx, queryOperation, q, variables, name)
 }
 
@@ -73,26 +83,50 @@ func (c *Client) NamedQueryRaw(ctx context.Context, name string, q interface{},
 // with a mutation derived from m, populating the response into it.
 // m should be a pointer to struct that corresponds to the GraphQL schema.
 // return raw bytes message.
-func (c *Client) MutateRaw(ctx context.Context, m interface{}, variables map[string]interface{}) (*json.RawMessage, error) {
+func (c *Client) MutateRaw(ctx context.Context, m interface{}, variables interface{}) (*json.RawMessage, error) {
 	return c.doRaw(ctx, mutationOperation, m, variables, "")
 }
 
 // NamedMutateRaw executes a single GraphQL mutation request, with operation name
 // return raw bytes message.
-func (c *Client) NamedMutateRaw(ctx context.Context, name string, m interface{}, variables map[string]interface{}) (*json.RawMessage, error) {
+func (c *Client) NamedMutateRaw(ctx context.Context, name string, m interface{}, variables interface{}) (*json.RawMessage, error) {
 	return c.doRaw(ctx, mutationOperation, m, variables, name)
 }
 
 // do executes a single GraphQL operation.
 // return raw message and error
-func (c *Client) doRaw(ctx context.Context, op operationType, v interface{}, variables map[string]interface{}, name string) (*json.RawMessage, error) {
+func (c *Client) doRaw(ctx context.Context, op operationType, v interface{}, vars interface{}, name string) (*json.RawMessage, error) {
+	variables, err := variablesMap(vars)
+	if err != nil {
+		return nil, err
+	}
 	var query string
 	switch op {
 	case queryOperation:
-		query = constructQuery(v, variables, name)
+		query, err = constructQuery(v, variables, name)
 	case mutationOperation:
-		query = constructMutation(v, variables, name)
+		query, err = constructMutation(v, variables, name)
+	}
+	if err == nil {
+		err = c.validate(query, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.request(ctx, query, variables)
+}
+
+// validate validates the operation constructed for v, or built at runtime if v is nil, if the client has a schema.
+func (c *Client) validate(query string, v interface{}) error {
+	if c.schema == nil {
+		return nil
 	}
+	return c.schema.validate(query, v)
+}
+
+// request sends a single GraphQL operation.
+// return raw message and error
+func (c *Client) request(ctx context.Context, query string, variables map[string]interface{}) (*json.RawMessage, error) {
 	in := struct {
 		Query     string                 `json:"query"`
 		Variables map[string]interface{} `json:"variables,omitempty"`
@@ -133,14 +167,24 @@ func (c *Client) doRaw(ctx context.Context, op operationType, v interface{}, var
 }
 
 // do executes a single GraphQL operation and unmarshal json.
-func (c *Client) do(ctx context.Context, op operationType, v interface{}, variables map[string]interface{}, name string) error {
+func (c *Client) do(ctx context.Context, op operationType, v interface{}, vars interface{}, name string) error {
+	variables, err := variablesMap(vars)
+	if err != nil {
+		return err
+	}
 
 	var query string
 	switch op {
 	case queryOperation:
-		query = constructQuery(v, variables, name)
+		query, err = constructQuery(v, variables, name)
 	case mutationOperation:
-		query = constructMutation(v, variables, name)
+		query, err = constructMutation(v, variables, name)
+	}
+	if err == nil {
+		err = c.validate(query, v)
+	}
+	if err != nil {
+		return err
 	}
 	in := struct {
 		Query     string                 `json:"query"`
@@ -150,7 +194,7 @@ func (c *Client) do(ctx context.Context, op operationType, v interface{}, variab
 		Variables: variables,
 	}
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(in)
+	err = json.NewEncoder(&buf).Encode(in)
 	if err != nil {
 		return err
 	}
@@ -165,6 +165,35 @@ func TestClient_Query_emptyVariables(t *testing.T) {
 	}
 }
 
+func TestClient_Query_variablesStruct(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, req *http.Request) {
+		body := mustRead(req.Body)
+		if got, want := body, `{"query":"query ($id:ID!){user(id: $id){name}}","variables":{"id":"1"}}`+"\n"; got != want {
+			t.Errorf("got body: %v, want %v", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		mustWrite(w, `{"data": {"user": {"name": "Gopher"}}}`)
+	})
+	client := graphql.NewClient("/graphql", &http.Client{Transport: localRoundTripper{handler: mux}})
+
+	var q struct {
+		User struct {
+			Name string
+		} `graphql:"user(id: $id)"`
+	}
+	variables := struct {
+		ID string `graphql:"id,type=ID!"`
+	}{ID: "1"}
+	err := client.Query(context.Background(), &q, variables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := q.User.Name, "Gopher"; got != want {
+		t.Errorf("got q.User.Name: %q, want: %q", got, want)
+	}
+}
+
 // localRoundTripper is an http.RoundTripper that executes HTTP transactions
 // by using handler directly, instead of going over an HTTP connection.
 type localRoundTripper struct {
@@ -191,3 +220,44 @@ func mustWrite(w io.Writer, s string) {
 		panic(err)
 	}
 }
+
+// UserFields is a named fragment.
+type UserFields struct {
+	Name  graphql.GqlString
+	Email graphql.GqlString
+}
+
+func (UserFields) GraphQLFragment() (string, string) { return "UserFields", "User" }
+
+func TestClient_Query_fragments(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, req *http.Request) {
+		body := mustRead(req.Body)
+		if got, want := body, `{"query":"{viewer{...UserFields},author{...UserFields,id}}fragment UserFields on User{name,email}"}`+"\n"; got != want {
+			t.Errorf("got body: %v, want %v", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		mustWrite(w, `{"data": {"viewer": {"name": "Gopher", "email": "gopher@example.com"}, "author": {"name": "Ada", "email": "ada@example.com", "id": "1"}}}`)
+	})
+	client := graphql.NewClient("/graphql", &http.Client{Transport: localRoundTripper{handler: mux}})
+
+	var q struct {
+		Viewer UserFields
+		Author struct {
+			UserFields
+			ID graphql.GqlString
+		}
+	}
+	if err := client.Query(context.Background(), &q, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := q.Viewer.Email.String, "gopher@example.com"; got != want {
+		t.Errorf("got viewer email %q, want: %q", got, want)
+	}
+	if got, want := q.Author.Name.String, "Ada"; got != want {
+		t.Errorf("got author name %q, want: %q", got, want)
+	}
+	if got, want := q.Author.ID.String, "1"; got != want {
+		t.Errorf("got author id %q, want: %q", got, want)
+	}
+}
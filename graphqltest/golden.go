@@ -0,0 +1,86 @@
+package graphqltest
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/machship-mm/go-graphql-client"
+)
+
+// update regenerates golden files instead of comparing them, e.g. go test ./... -update-graphql
+var update = flag.Bool("update-graphql", false, "update golden .graphql files")
+
+// AssertGolden compares the pretty-printed operation to the golden file at path.
+// With the -update-graphql flag, the golden file is written instead
+func AssertGolden(t testing.TB, path string, operation string) {
+	t.Helper()
+	got := graphql.PrettyPrint(operation) + "\n"
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s. Run the test with -update-graphql to create the golden file", err)
+	}
+	if got != string(want) {
+		t.Errorf("operation doesn't match %s. Run the test with -update-graphql to update the golden file\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// AssertQuery compares the query constructed for q and variables to the golden file at path
+func AssertQuery(t testing.TB, path string, q interface{}, variables interface{}) {
+	t.Helper()
+	assertConstructed(t, path)(graphql.ConstructQuery(q, variables, ""))
+}
+
+// AssertNamedQuery compares the query constructed for q and variables, with operation name, to the golden file at path
+func AssertNamedQuery(t testing.TB, path string, name string, q interface{}, variables interface{}) {
+	t.Helper()
+	assertConstructed(t, path)(graphql.ConstructQuery(q, variables, name))
+}
+
+// AssertMutation compares the mutation constructed for m and variables to the golden file at path
+func AssertMutation(t testing.TB, path string, m interface{}, variables interface{}) {
+	t.Helper()
+	assertConstructed(t, path)(graphql.ConstructMutation(m, variables, ""))
+}
+
+// AssertNamedMutation compares the mutation constructed for m and variables, with operation name, to the golden file at path
+func AssertNamedMutation(t testing.TB, path string, name string, m interface{}, variables interface{}) {
+	t.Helper()
+	assertConstructed(t, path)(graphql.ConstructMutation(m, variables, name))
+}
+
+// AssertSubscription compares the subscription constructed for v and variables to the golden file at path
+func AssertSubscription(t testing.TB, path string, v interface{}, variables interface{}) {
+	t.Helper()
+	assertConstructed(t, path)(graphql.ConstructSubscription(v, variables, ""))
+}
+
+// AssertNamedSubscription compares the subscription constructed for v and variables, with operation name, to the golden file at path
+func AssertNamedSubscription(t testing.TB, path string, name string, v interface{}, variables interface{}) {
+	t.Helper()
+	assertConstructed(t, path)(graphql.ConstructSubscription(v, variables, name))
+}
+
+// assertConstructed returns a function comparing the constructed operation to the golden file at path
+func assertConstructed(t testing.TB, path string) func(operation string, err error) {
+	return func(operation string, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertGolden(t, path, operation)
+	}
+}
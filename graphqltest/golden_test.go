@@ -0,0 +1,32 @@
+package graphqltest_test
+
+import (
+	"testing"
+
+	"github.com/machship-mm/go-graphql-client"
+	"github.com/machship-mm/go-graphql-client/graphqltest"
+)
+
+// ID is a custom scalar for the variables
+type ID string
+
+func TestAssertNamedQuery(t *testing.T) {
+	var q struct {
+		User struct {
+			Name  graphql.GqlString
+			Posts []struct {
+				Title graphql.GqlString
+			} `graphql:"posts(first: 10)"`
+		} `graphql:"getUser(id: $id)"`
+	}
+	graphqltest.AssertNamedQuery(t, "testdata/get_user.graphql", "GetUser", q, map[string]interface{}{"id": ID("1")})
+}
+
+func TestAssertSubscription(t *testing.T) {
+	var s struct {
+		Event struct {
+			ID graphql.GqlString
+		}
+	}
+	graphqltest.AssertSubscription(t, "testdata/event.graphql", s, nil)
+}
@@ -0,0 +1,413 @@
+// Package graphqltest provides a local GraphQL server for testing code that uses Client and SubscriptionClient.
+//
+// Tests register the operations they expect by operation name or query matcher, with canned responses,
+// errors, delays or streamed subscription events, and assert on the received requests afterwards.
+package graphqltest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/machship-mm/go-graphql-client"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Request is an operation received by the server
+type Request struct {
+	Query         string
+	OperationName string
+	Variables     map[string]interface{}
+	// Header contains the HTTP request headers, or the headers of the websocket handshake
+	Header http.Header
+	// InitPayload is the connection_init payload of the websocket connection, nil for HTTP requests
+	InitPayload json.RawMessage
+	Websocket   bool
+}
+
+// Matcher selects the operations a registered response applies to
+type Matcher func(req *Request) bool
+
+// OperationName matches operations with the given name
+func OperationName(name string) Matcher {
+	return func(req *Request) bool {
+		return req.OperationName == name
+	}
+}
+
+// QueryContains matches operations whose query contains s
+func QueryContains(s string) Matcher {
+	return func(req *Request) bool {
+		return strings.Contains(req.Query, s)
+	}
+}
+
+// QueryMatches matches operations whose query matches the regular expression
+func QueryMatches(re *regexp.Regexp) Matcher {
+	return func(req *Request) bool {
+		return re.MatchString(req.Query)
+	}
+}
+
+// Operation is an expected operation and its canned response
+type Operation struct {
+	matcher Matcher
+
+	mu       sync.Mutex
+	data     []json.RawMessage
+	errors   []string
+	delay    time.Duration
+	keepOpen bool
+	requests []Request
+}
+
+// Respond sets the data of the response, e.g. `{"viewer":{"login":"gopher"}}`
+func (op *Operation) Respond(data string) *Operation {
+	return op.Stream(data)
+}
+
+// Stream sets the data of the events sent to a subscription, in order. HTTP requests receive the first event
+func (op *Operation) Stream(events ...string) *Operation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.data = nil
+	for _, e := range events {
+		op.data = append(op.data, json.RawMessage(e))
+	}
+	return op
+}
+
+// RespondError adds an error with the message to the response
+func (op *Operation) RespondError(message string) *Operation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.errors = append(op.errors, message)
+	return op
+}
+
+// Delay delays the response, and every streamed event of a subscription
+func (op *Operation) Delay(delay time.Duration) *Operation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.delay = delay
+	return op
+}
+
+// KeepOpen leaves subscriptions open after the streamed events, instead of completing them
+func (op *Operation) KeepOpen() *Operation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.keepOpen = true
+	return op
+}
+
+// Calls returns the number of requests the operation received
+func (op *Operation) Calls() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return len(op.requests)
+}
+
+// Requests returns the requests the operation received
+func (op *Operation) Requests() []Request {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return append([]Request(nil), op.requests...)
+}
+
+// LastRequest returns the last request the operation received, or nil
+func (op *Operation) LastRequest() *Request {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if len(op.requests) == 0 {
+		return nil
+	}
+	req := op.requests[len(op.requests)-1]
+	return &req
+}
+
+// response is the payload of a single result
+type response struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []responseError `json:"errors,omitempty"`
+}
+
+type responseError struct {
+	Message string `json:"message"`
+}
+
+// responses returns the results to send for a request
+func (op *Operation) responses() ([]response, time.Duration, bool) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	var errs []responseError
+	for _, message := range op.errors {
+		errs = append(errs, responseError{Message: message})
+	}
+	data := op.data
+	if len(data) == 0 {
+		data = []json.RawMessage{json.RawMessage("null")}
+	}
+	var responses []response
+	for _, d := range data {
+		responses = append(responses, response{Data: d, Errors: errs})
+	}
+	return responses, op.delay, op.keepOpen
+}
+
+// Server is a local GraphQL server. It accepts HTTP requests and websocket connections on the same URL,
+// with both the graphql-ws and graphql-transport-ws protocols
+type Server struct {
+	*httptest.Server
+	// Protocols are the websocket subprotocols accepted by the server, in order of preference
+	Protocols []string
+
+	mu         sync.Mutex
+	operations []*Operation
+	unmatched  []Request
+}
+
+// NewServer starts a server. Close it when the test is done
+func NewServer() *Server {
+	s := &Server{
+		Protocols: []string{string(graphql.GraphQLTransportWS), string(graphql.SubscriptionsTransportWS)},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// WebsocketURL returns the URL for SubscriptionClient
+func (s *Server) WebsocketURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// Handle registers an expected operation. The first registered operation that matches a request handles it
+func (s *Server) Handle(matcher Matcher) *Operation {
+	op := &Operation{matcher: matcher}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.operations = append(s.operations, op)
+	return op
+}
+
+// Unmatched returns the requests that matched no registered operation
+func (s *Server) Unmatched() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.unmatched...)
+}
+
+// match finds the operation for req and records the request
+func (s *Server) match(req Request) *Operation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, op := range s.operations {
+		if op.matcher(&req) {
+			op.mu.Lock()
+			op.requests = append(op.requests, req)
+			op.mu.Unlock()
+			return op
+		}
+	}
+	s.unmatched = append(s.unmatched, req)
+	return nil
+}
+
+func unmatchedResponse(req Request) response {
+	return response{
+		Data:   json.RawMessage("null"),
+		Errors: []responseError{{Message: fmt.Sprintf("graphqltest: no operation matches %q", req.Query)}},
+	}
+}
+
+// operationPattern matches the operation type and name at the start of a query
+var operationPattern = regexp.MustCompile(`^\s*(?:query|mutation|subscription)\s*([_A-Za-z][_0-9A-Za-z]*)?`)
+
+// operationName returns the name of the operation in query
+func operationName(query string) string {
+	m := operationPattern.FindStringSubmatch(query)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+type payload struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func newRequest(p payload, header http.Header) Request {
+	name := p.OperationName
+	if name == "" {
+		name = operationName(p.Query)
+	}
+	return Request{
+		Query:         p.Query,
+		OperationName: name,
+		Variables:     p.Variables,
+		Header:        header,
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		s.serveWebsocket(w, r)
+		return
+	}
+
+	var p payload
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := newRequest(p, r.Header.Clone())
+	resp := unmatchedResponse(req)
+	if op := s.match(req); op != nil {
+		responses, delay, _ := op.responses()
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		resp = responses[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: s.Protocols})
+	if err != nil {
+		return
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	conn := &wsConn{
+		Conn:       c,
+		header:     r.Header.Clone(),
+		protocol:   graphql.SubscriptionProtocolType(c.Subprotocol()),
+		operations: make(map[string]context.CancelFunc),
+	}
+	if conn.protocol == "" {
+		conn.protocol = graphql.SubscriptionsTransportWS
+	}
+	for {
+		var msg graphql.OperationMessage
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case graphql.GQL_CONNECTION_INIT:
+			conn.initPayload = msg.Payload
+			conn.write(ctx, graphql.OperationMessage{Type: graphql.GQL_CONNECTION_ACK})
+		case graphql.GQL_PING:
+			conn.write(ctx, graphql.OperationMessage{Type: graphql.GQL_PONG})
+		case graphql.GQL_START, graphql.GQL_SUBSCRIBE:
+			var p payload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				conn.write(ctx, graphql.OperationMessage{ID: msg.ID, Type: graphql.GQL_ERROR, Payload: conn.errorPayload(err.Error())})
+				continue
+			}
+			req := newRequest(p, conn.header)
+			req.InitPayload = conn.initPayload
+			req.Websocket = true
+			// register before serving, so that a stop message right after the start isn't lost
+			go conn.serveOperation(conn.register(ctx, msg.ID), msg.ID, req, s.match(req))
+		case graphql.GQL_STOP, graphql.GQL_COMPLETE:
+			conn.stop(msg.ID)
+		case graphql.GQL_CONNECTION_TERMINATE:
+			return
+		}
+	}
+}
+
+// wsConn is a websocket connection of the server
+type wsConn struct {
+	*websocket.Conn
+	header      http.Header
+	protocol    graphql.SubscriptionProtocolType
+	initPayload json.RawMessage
+
+	mu         sync.Mutex
+	operations map[string]context.CancelFunc
+}
+
+func (c *wsConn) write(ctx context.Context, msg graphql.OperationMessage) {
+	_ = wsjson.Write(ctx, c.Conn, msg)
+}
+
+// errorPayload encodes an error message payload for the protocol of the connection
+func (c *wsConn) errorPayload(message string) json.RawMessage {
+	var v interface{} = responseError{Message: message}
+	if c.protocol == graphql.GraphQLTransportWS {
+		v = []responseError{{Message: message}}
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// register returns the context of the operation id, cancelled when the client stops it
+func (c *wsConn) register(ctx context.Context, id string) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.operations[id] = cancel
+	c.mu.Unlock()
+	return ctx
+}
+
+func (c *wsConn) stop(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel, ok := c.operations[id]; ok {
+		cancel()
+		delete(c.operations, id)
+	}
+}
+
+// serveOperation sends the responses of op until they are all sent or the client stops the operation
+// ctx is the context returned by register for id
+func (c *wsConn) serveOperation(ctx context.Context, id string, req Request, op *Operation) {
+	defer c.stop(id)
+
+	dataType := graphql.GQL_DATA
+	if c.protocol == graphql.GraphQLTransportWS {
+		dataType = graphql.GQL_NEXT
+	}
+
+	responses := []response{unmatchedResponse(req)}
+	var delay time.Duration
+	var keepOpen bool
+	if op != nil {
+		responses, delay, keepOpen = op.responses()
+	}
+	for _, resp := range responses {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		b, err := json.Marshal(resp)
+		if err != nil {
+			return
+		}
+		c.write(ctx, graphql.OperationMessage{ID: id, Type: dataType, Payload: b})
+	}
+	if keepOpen {
+		<-ctx.Done()
+		return
+	}
+	c.write(ctx, graphql.OperationMessage{ID: id, Type: graphql.GQL_COMPLETE})
+}
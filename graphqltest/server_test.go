@@ -0,0 +1,156 @@
+package graphqltest_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/machship-mm/go-graphql-client"
+	"github.com/machship-mm/go-graphql-client/graphqltest"
+)
+
+// headerTransport adds a header to every request
+type headerTransport struct {
+	key, value string
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(t.key, t.value)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestServer_Client(t *testing.T) {
+	server := graphqltest.NewServer()
+	defer server.Close()
+
+	user := server.Handle(graphqltest.OperationName("GetUser")).Respond(`{"user":{"name":"gopher"}}`)
+	server.Handle(graphqltest.QueryMatches(regexp.MustCompile(`^mutation`))).RespondError("forbidden")
+
+	client := graphql.NewClient(server.URL, &http.Client{Transport: headerTransport{"Authorization", "Bearer token"}})
+
+	var q struct {
+		User struct {
+			Name graphql.GqlString
+		} `graphql:"user(id: $id)"`
+	}
+	err := client.NamedQuery(context.Background(), "GetUser", &q, map[string]interface{}{"id": graphql.NewStringStruct("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := q.User.Name.String, "gopher"; got != want {
+		t.Errorf("got name %q, want: %q", got, want)
+	}
+	if got := user.Calls(); got != 1 {
+		t.Errorf("got %d calls, want: 1", got)
+	}
+	req := user.LastRequest()
+	if got, want := req.Variables["id"], "1"; got != want {
+		t.Errorf("got variable id %v, want: %v", got, want)
+	}
+	if got, want := req.Header.Get("Authorization"), "Bearer token"; got != want {
+		t.Errorf("got Authorization header %q, want: %q", got, want)
+	}
+
+	var m struct {
+		DeleteUser struct {
+			ID graphql.GqlString
+		}
+	}
+	if err := client.Mutate(context.Background(), &m, nil); err == nil || err.Error() != "forbidden" {
+		t.Errorf("got error: %v, want: forbidden", err)
+	}
+
+	var other struct {
+		Other graphql.GqlString
+	}
+	if err := client.Query(context.Background(), &other, nil); err == nil {
+		t.Error("got no error for an unmatched operation")
+	}
+	if got := len(server.Unmatched()); got != 1 {
+		t.Errorf("got %d unmatched requests, want: 1", got)
+	}
+}
+
+func TestServer_Client_delay(t *testing.T) {
+	server := graphqltest.NewServer()
+	defer server.Close()
+	server.Handle(graphqltest.QueryContains("slow")).Respond(`{"slow":"done"}`).Delay(time.Second)
+
+	client := graphql.NewClient(server.URL, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var q struct {
+		Slow graphql.GqlString
+	}
+	if err := client.Query(ctx, &q, nil); err == nil {
+		t.Error("got no error, want deadline exceeded")
+	}
+}
+
+func TestServer_SubscriptionClient(t *testing.T) {
+	for _, protocol := range []graphql.SubscriptionProtocolType{graphql.SubscriptionsTransportWS, graphql.GraphQLTransportWS} {
+		server := graphqltest.NewServer()
+		events := server.Handle(graphqltest.OperationName("Events")).
+			Stream(`{"event":{"id":1}}`, `{"event":{"id":2}}`).
+			Delay(time.Millisecond)
+
+		client := graphql.NewSubscriptionClient(server.WebsocketURL()).
+			WithProtocol(protocol).
+			WithConnectionParams(map[string]interface{}{"token": "secret"})
+		go client.Run()
+
+		var sub struct {
+			Event struct {
+				ID graphql.GqlInt64
+			}
+		}
+		received := make(chan int64, 2)
+		handle, err := client.NamedSubscribeIntoWithContext(context.Background(), "Events", sub, nil, func(data interface{}, err error) error {
+			if err != nil {
+				t.Error(err)
+				return nil
+			}
+			received <- data.(*struct {
+				Event struct {
+					ID graphql.GqlInt64
+				}
+			}).Event.ID.Int64
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for want := int64(1); want <= 2; want++ {
+			select {
+			case got := <-received:
+				if got != want {
+					t.Errorf("%s: got event %d, want: %d", protocol, got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timed out waiting for event %d", protocol, want)
+			}
+		}
+		select {
+		case <-handle.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for completion", protocol)
+		}
+
+		req := events.LastRequest()
+		if req == nil || !req.Websocket {
+			t.Fatalf("%s: got request %+v, want a websocket request", protocol, req)
+		}
+		var params map[string]string
+		if err := json.Unmarshal(req.InitPayload, &params); err != nil || params["token"] != "secret" {
+			t.Errorf("%s: got init payload %s, want the connection params", protocol, req.InitPayload)
+		}
+
+		_ = client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,91 @@
+package jsonutil
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/machship-mm/go-graphql-client/ident"
+)
+
+// aliasCache caches AutoAliases results by struct type.
+var aliasCache sync.Map // map[reflect.Type]map[int]string
+
+// AutoAliases returns the aliases generated for the fields of struct type t whose response keys collide,
+// e.g. the same field queried twice with different arguments, by field index.
+// Fields with an explicit alias keep it, the others are aliased by their Go field name in lower camel case,
+// suffixed by a number if another field already has that response key.
+// The query builder and the decoder both use it, so aliased response keys map back to the right fields.
+func AutoAliases(t reflect.Type) map[int]string {
+	if cached, ok := aliasCache.Load(t); ok {
+		return cached.(map[int]string)
+	}
+
+	keys := make(map[string][]int)
+	explicit := make(map[int]bool)
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		key, hasAlias, ok := responseKey(t.Field(i))
+		if !ok {
+			continue
+		}
+		keys[key] = append(keys[key], i)
+		explicit[i] = hasAlias
+		fields = append(fields, i)
+	}
+
+	// the response keys of the fields that aren't aliased automatically
+	taken := make(map[string]bool)
+	for key, indexes := range keys {
+		for _, i := range indexes {
+			if len(indexes) < 2 || explicit[i] {
+				taken[key] = true
+			}
+		}
+	}
+
+	aliases := make(map[int]string)
+	for _, i := range fields {
+		key, _, _ := responseKey(t.Field(i))
+		if len(keys[key]) < 2 || explicit[i] {
+			continue
+		}
+		name := ident.ParseMixedCaps(t.Field(i).Name).ToLowerCamelCase()
+		alias := name
+		for n := 2; taken[alias]; n++ {
+			alias = name + strconv.Itoa(n)
+		}
+		taken[alias] = true
+		aliases[i] = alias
+	}
+	aliasCache.Store(t, aliases)
+	return aliases
+}
+
+// responseKey returns the key of struct field f in the response, and whether it's an explicit alias.
+// It returns false for fields that aren't queried or have no key, such as fragments and embedded structs.
+func responseKey(f reflect.StructField) (key string, hasAlias bool, ok bool) {
+	value, tagged := f.Tag.Lookup("graphql")
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "-", strings.HasPrefix(value, "..."):
+		return "", false, false
+	case !tagged && f.Anonymous:
+		return "", false, false
+	}
+	if i := strings.Index(value, "@"); i != -1 {
+		value = value[:i]
+	}
+	if i := strings.Index(value, "("); i != -1 {
+		value = value[:i]
+	}
+	if i := strings.Index(value, ":"); i != -1 {
+		return strings.TrimSpace(value[:i]), true, true
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		value = ident.ParseMixedCaps(f.Name).ToLowerCamelCase()
+	}
+	return value, false, true
+}
@@ -255,11 +255,21 @@ func (d *decoder) popAllVs() {
 // fieldByGraphQLName returns an exported struct field of struct v
 // that matches GraphQL name, or invalid reflect.Value if none found.
 func fieldByGraphQLName(v reflect.Value, name string) reflect.Value {
+	aliases := AutoAliases(v.Type())
+	for i, alias := range aliases {
+		if alias == name && v.Type().Field(i).PkgPath == "" {
+			return v.Field(i)
+		}
+	}
 	for i := 0; i < v.NumField(); i++ {
 		if v.Type().Field(i).PkgPath != "" {
 			// Skip unexported field.
 			continue
 		}
+		if _, ok := aliases[i]; ok {
+			// The response key is the generated alias.
+			continue
+		}
 		if hasGraphQLName(v.Type().Field(i), name) {
 			return v.Field(i)
 		}
@@ -280,13 +290,22 @@ func hasGraphQLName(f reflect.StructField, name string) bool {
 		// GraphQL fragment. It doesn't have a name.
 		return false
 	}
+	// Directives follow the name and arguments, e.g. "details(first: 1) @include(if: $withDetails)".
+	if i := strings.Index(value, "@"); i != -1 {
+		value = value[:i]
+	}
 	if i := strings.Index(value, "("); i != -1 {
 		value = value[:i]
 	}
 	if i := strings.Index(value, ":"); i != -1 {
 		value = value[:i]
 	}
-	return strings.TrimSpace(value) == name
+	value = strings.TrimSpace(value)
+	if value == "" {
+		// Only directives, the name is derived from the field name.
+		return strings.EqualFold(f.Name, name)
+	}
+	return value == name
 }
 
 // isGraphQLFragment reports whether struct field f is a GraphQL fragment.
@@ -62,6 +62,66 @@ func TestUnmarshalGraphQL_graphqlTag(t *testing.T) {
 	}
 }
 
+func TestUnmarshalGraphQL_directives(t *testing.T) {
+	type query struct {
+		Foo     graphql.GqlString  `graphql:"foo @include(if: $withFoo)"`
+		Bar     graphql.GqlString  `graphql:"bar(email: \"a@b.c\") @skip(if: $noBar)"`
+		Details *graphql.GqlString `graphql:"@include(if: $withDetails)"`
+		Users   []struct {
+			Name graphql.GqlString
+		} `graphql:"users: queryUser @cascade"`
+	}
+	var got query
+	err := jsonutil.UnmarshalGraphQL([]byte(`{
+		"foo": "foo",
+		"bar": "bar",
+		"users": [{"name": "gopher"}]
+	}`), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Foo.String != "foo" || got.Bar.String != "bar" {
+		t.Errorf("got %+v, want foo and bar", got)
+	}
+	if got.Details != nil {
+		t.Errorf("got details %v, want nil for the excluded field", got.Details)
+	}
+	if len(got.Users) != 1 || got.Users[0].Name.String != "gopher" {
+		t.Errorf("got users %+v, want gopher", got.Users)
+	}
+}
+
+func TestUnmarshalGraphQL_autoAliases(t *testing.T) {
+	type user struct {
+		Name graphql.GqlString
+	}
+	type query struct {
+		ActiveUsers  []user `graphql:"queryUser(filter: {active: true})"`
+		BlockedUsers []user `graphql:"queryUser(filter: {blocked: true})"`
+		Viewer       user
+		Active       []user `graphql:"activeUsers"`
+	}
+	var got query
+	err := jsonutil.UnmarshalGraphQL([]byte(`{
+		"activeUsers2": [{"name": "a"}],
+		"blockedUsers": [{"name": "b"}],
+		"viewer": {"name": "v"},
+		"activeUsers": [{"name": "c"}]
+	}`), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := query{
+		ActiveUsers:  []user{{Name: graphql.NewStringStruct("a")}},
+		BlockedUsers: []user{{Name: graphql.NewStringStruct("b")}},
+		Viewer:       user{Name: graphql.NewStringStruct("v")},
+		Active:       []user{{Name: graphql.NewStringStruct("c")}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
 func TestUnmarshalGraphQL_jsonTag(t *testing.T) {
 	type query struct {
 		Foo *graphql.GqlString `json:"baz"`
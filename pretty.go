@@ -0,0 +1,108 @@
+package graphql
+
+import "strings"
+
+// PrettyQuery returns the query the client sends for q and variables, with optional operation name,
+// as an indented, multi-line document for logs and error reports.
+func PrettyQuery(q interface{}, variables interface{}, name string) (string, error) {
+	return prettyPrint(ConstructQuery(q, variables, name))
+}
+
+// PrettyMutation returns the mutation the client sends for m and variables, with optional operation name,
+// as an indented, multi-line document for logs and error reports.
+func PrettyMutation(m interface{}, variables interface{}, name string) (string, error) {
+	return prettyPrint(ConstructMutation(m, variables, name))
+}
+
+// PrettySubscription returns the subscription the client sends for v and variables, with optional operation name,
+// as an indented, multi-line document for logs and error reports.
+func PrettySubscription(v interface{}, variables interface{}, name string) (string, error) {
+	return prettyPrint(ConstructSubscription(v, variables, name))
+}
+
+func prettyPrint(query string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	return PrettyPrint(query), nil
+}
+
+// PrettyPrint formats a minified operation, as constructed by the client, with one field per line.
+// Arguments are kept as they are, except for the variable definitions of the operation.
+//
+// E.g., "query ($id:ID!){user(id: $id){name,email}}" ->
+//
+//	query ($id: ID!) {
+//	  user(id: $id) {
+//	    name
+//	    email
+//	  }
+//	}
+func PrettyPrint(query string) string {
+	var buf strings.Builder
+	level, parens := 0, 0
+	inString, header := false, true
+
+	newline := func() {
+		buf.WriteString("\n")
+		buf.WriteString(strings.Repeat("  ", level))
+	}
+
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		if inString {
+			buf.WriteByte(ch)
+			if ch == '\\' && i+1 < len(query) {
+				i++
+				buf.WriteByte(query[i])
+			} else if ch == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case ch == '"':
+			inString = true
+			buf.WriteByte(ch)
+		case ch == '(':
+			parens++
+			buf.WriteByte(ch)
+		case ch == ')':
+			parens--
+			buf.WriteByte(ch)
+		case parens > 0:
+			// separate the variable definitions of the operation
+			if header && ch == '$' && query[i-1] != '(' {
+				buf.WriteString(", ")
+			}
+			buf.WriteByte(ch)
+			if header && ch == ':' {
+				buf.WriteString(" ")
+			}
+		case ch == '{':
+			if s := strings.TrimRight(buf.String(), " "); s != "" {
+				buf.Reset()
+				buf.WriteString(s)
+				buf.WriteString(" ")
+			}
+			buf.WriteByte(ch)
+			level++
+			header = false
+			newline()
+		case ch == '}':
+			level--
+			newline()
+			buf.WriteByte(ch)
+			if level == 0 && i+1 < len(query) {
+				// separate the fragment definitions that follow
+				buf.WriteString("\n\n")
+			}
+		case ch == ',':
+			newline()
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,92 @@
+package graphql
+
+import "testing"
+
+func TestPrettyPrint(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{
+			in: `{viewer{login,createdAt}}`,
+			want: `{
+  viewer {
+    login
+    createdAt
+  }
+}`,
+		},
+		{
+			in: `query SearchRepository($issueNumber:Int!$repositoryName:String!){repository(owner: "a,b", name: $repositoryName){issue(number: $issueNumber){body}}}`,
+			want: `query SearchRepository($issueNumber: Int!, $repositoryName: String!) {
+  repository(owner: "a,b", name: $repositoryName) {
+    issue(number: $issueNumber) {
+      body
+    }
+  }
+}`,
+		},
+		{
+			in: `subscription{actor{login},... on IssueComment{body},label{name,color}}`,
+			want: `subscription {
+  actor {
+    login
+  }
+  ... on IssueComment {
+    body
+  }
+  label {
+    name
+    color
+  }
+}`,
+		},
+		{
+			in: `mutation{addTodo(text:"{not,fields}"){id}}`,
+			want: `mutation {
+  addTodo(text:"{not,fields}") {
+    id
+  }
+}`,
+		},
+	}
+	for _, tc := range tests {
+		if got := PrettyPrint(tc.in); got != tc.want {
+			t.Errorf("\ngot:\n%s\nwant:\n%s", got, tc.want)
+		}
+	}
+}
+
+func TestPrettyQuery(t *testing.T) {
+	var q struct {
+		User struct {
+			userFields
+			ID GqlString
+		} `graphql:"user(id: $id)"`
+	}
+	variables := struct {
+		ID string `graphql:"id,type=ID!"`
+	}{ID: "1"}
+	want := `query GetUser($id: ID!) {
+  user(id: $id) {
+    ...UserFields
+    id
+  }
+}
+
+fragment UserFields on User {
+  name
+  email
+}`
+	got, err := PrettyQuery(q, variables, "GetUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := PrettyMutation(q, map[string]interface{}{"id": nil}, ""); err == nil {
+		t.Error("got nil error for a nil variable")
+	}
+}
@@ -7,48 +7,100 @@ import (
 	"io"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/machship-mm/go-graphql-client/ident"
+	"github.com/machship-mm/go-graphql-client/internal/jsonutil"
 )
 
-func constructQuery(v interface{}, variables map[string]interface{}, name string) string {
-	query := query(v)
+// ConstructQuery returns the minified query the client sends for q and variables, with optional operation name.
+func ConstructQuery(q interface{}, variables interface{}, name string) (string, error) {
+	vars, err := variablesMap(variables)
+	if err != nil {
+		return "", err
+	}
+	return constructQuery(q, vars, name)
+}
+
+// ConstructMutation returns the minified mutation the client sends for m and variables, with optional operation name.
+func ConstructMutation(m interface{}, variables interface{}, name string) (string, error) {
+	vars, err := variablesMap(variables)
+	if err != nil {
+		return "", err
+	}
+	return constructMutation(m, vars, name)
+}
+
+// ConstructSubscription returns the minified subscription the client sends for v and variables, with optional operation name.
+func ConstructSubscription(v interface{}, variables interface{}, name string) (string, error) {
+	vars, err := variablesMap(variables)
+	if err != nil {
+		return "", err
+	}
+	return constructSubscription(v, vars, name)
+}
+
+func constructQuery(v interface{}, variables map[string]interface{}, name string) (string, error) {
+	query, err := query(v)
+	if err != nil {
+		return "", err
+	}
 	if len(variables) > 0 {
-		return "query " + name + "(" + queryArguments(variables, false) + ")" + query
+		arguments, err := queryArguments(variables)
+		if err != nil {
+			return "", err
+		}
+		return "query " + name + "(" + arguments + ")" + query, nil
 	}
 
 	if name != "" {
-		return "query " + name + query
+		return "query " + name + query, nil
 	}
-	return query
+	return query, nil
 }
 
-func constructMutation(v interface{}, variables map[string]interface{}, name string) string {
-	query := query(v)
+func constructMutation(v interface{}, variables map[string]interface{}, name string) (string, error) {
+	query, err := query(v)
+	if err != nil {
+		return "", err
+	}
 	if len(variables) > 0 {
-		return "mutation " + name + "(" + queryArguments(variables, true) + ")" + query
+		arguments, err := queryArguments(variables)
+		if err != nil {
+			return "", err
+		}
+		return "mutation " + name + "(" + arguments + ")" + query, nil
 	}
 	if name != "" {
-		return "mutation " + name + query
+		return "mutation " + name + query, nil
 	}
-	return "mutation" + query
+	return "mutation" + query, nil
 }
 
-func constructSubscription(v interface{}, variables map[string]interface{}, name string) string {
-	query := query(v)
+func constructSubscription(v interface{}, variables map[string]interface{}, name string) (string, error) {
+	query, err := query(v)
+	if err != nil {
+		return "", err
+	}
 	if len(variables) > 0 {
-		return "subscription " + name + "(" + queryArguments(variables, false) + ")" + query
+		arguments, err := queryArguments(variables)
+		if err != nil {
+			return "", err
+		}
+		return "subscription " + name + "(" + arguments + ")" + query, nil
 	}
 	if name != "" {
-		return "subscription " + name + query
+		return "subscription " + name + query, nil
 	}
-	return "subscription" + query
+	return "subscription" + query, nil
 }
 
 // queryArguments constructs a minified arguments string for variables.
 //
 // E.g., map[string]interface{}{"a": Int(123), "b": NewBoolean(true)} -> "$a:Int!$b:Boolean".
-func queryArguments(variables map[string]interface{}, isMutation bool) string {
+func queryArguments(variables map[string]interface{}) (string, error) {
 	// Sort keys in order to produce deterministic output for testing purposes.
 	// TODO: If tests can be made to work with non-deterministic output, then no need to sort.
 	keys := make([]string, 0, len(variables))
@@ -59,52 +111,84 @@ func queryArguments(variables map[string]interface{}, isMutation bool) string {
 
 	var buf bytes.Buffer
 	for _, k := range keys {
+		typ, err := variableType(variables[k])
+		if err != nil {
+			return "", fmt.Errorf("variable %q: %w", k, err)
+		}
 		io.WriteString(&buf, "$")
 		io.WriteString(&buf, k)
 		io.WriteString(&buf, ":")
-		writeArgumentType(&buf, reflect.TypeOf(variables[k]), true, isMutation)
+		io.WriteString(&buf, typ)
 		// Don't insert a comma here.
 		// Commas in GraphQL are insignificant, and we want minified output.
 		// See https://facebook.github.io/graphql/October2016/#sec-Insignificant-Commas.
 	}
-	return buf.String()
+	return buf.String(), nil
+}
+
+// variableType returns the validated GraphQL type of the variable value v.
+func variableType(v interface{}) (string, error) {
+	v, marker, marked := unwrapMarkers(v)
+
+	var typ string
+	if tv, ok := v.(typedVariable); ok {
+		typ = tv.graphqlType
+	} else {
+		t := reflect.TypeOf(v)
+		if t == nil {
+			return "", fmt.Errorf("graphql: can't derive the type from nil, declare the variable type")
+		}
+		var buf bytes.Buffer
+		if err := writeArgumentType(&buf, t, true); err != nil {
+			return "", err
+		}
+		typ = buf.String()
+	}
+
+	if marked {
+		typ = strings.TrimSuffix(typ, "!")
+		if marker.nonNull {
+			typ += "!"
+		}
+	}
+	return typ, validateType(typ)
 }
 
 // writeArgumentType writes a minified GraphQL type for t to w.
 // value indicates whether t is a value (required) type or pointer (optional) type.
 // If value is true, then "!" is written at the end of t.
-func writeArgumentType(w io.Writer, t reflect.Type, value, isMutation bool) {
-	if t.Kind() == reflect.Ptr && !isMutation {
+// The same rules apply to queries, mutations and subscriptions.
+func writeArgumentType(w io.Writer, t reflect.Type, value bool) error {
+	if t.Kind() == reflect.Ptr {
 		// Pointer is an optional type, so no "!" at the end of the pointer's underlying type.
-		writeArgumentType(w, t.Elem(), false, isMutation)
-		return
-	} else if t.Kind() == reflect.Ptr {
-		writeArgumentType(w, t.Elem(), true, isMutation)
-		return
+		return writeArgumentType(w, t.Elem(), false)
 	}
 
-	switch t.Kind() {
-	case reflect.Slice, reflect.Array:
+	name, declared := declaredTypeName(t)
+	switch {
+	case declared:
+		// Declared type, even if it's a list in Go. E.g., "UUID".
+		io.WriteString(w, name)
+		if strings.HasSuffix(name, "!") {
+			// Declared non-null type, even through a pointer. E.g., "Int!".
+			return nil
+		}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		// Named arrays, e.g. uuid.UUID, and bytes are usually scalars, whose type must be declared.
+		if t.Kind() == reflect.Array && t.Name() != "" || t.Elem().Kind() == reflect.Uint8 {
+			return unmappedTypeError(t)
+		}
 		// List. E.g., "[Int]".
 		io.WriteString(w, "[")
-		writeArgumentType(w, t.Elem(), true, isMutation)
+		if err := writeArgumentType(w, t.Elem(), true); err != nil {
+			return err
+		}
 		io.WriteString(w, "]")
 	default:
 		// Named type. E.g., "Int".
-		name := t.Name()
-		switch name {
-		// case "string":
-		// 	name = "ID"
-		case "GqlBool":
-			name = "Boolean"
-		case "GqlFloat64":
-			name = "Float!"
-		case "GqlInt64":
-			name = "Int!"
-		case "GqlString":
-			name = "String!"
-		case "GqlTime":
-			name = "DateTime!"
+		name, err := graphqlTypeName(t)
+		if err != nil {
+			return err
 		}
 		io.WriteString(w, name)
 	}
@@ -113,64 +197,303 @@ func writeArgumentType(w io.Writer, t reflect.Type, value, isMutation bool) {
 		// Value is a required type, so add "!" to the end.
 		io.WriteString(w, "!")
 	}
+	return nil
+}
+
+// maxDepth is the number of times a struct type may be nested in itself within a query, see SetMaxDepth.
+var maxDepth int32 = 10
+
+// SetMaxDepth sets the number of times a struct type may be nested in itself within a query. The default is 10.
+// Constructing the query for a deeper type, e.g. an unbounded recursive type, fails instead of overflowing the stack.
+// Recursive fields are bounded with the depth tag, e.g. `depth:"2"`, which overrides the max depth, or the hasInverse tag.
+func SetMaxDepth(depth int) {
+	atomic.StoreInt32(&maxDepth, int32(depth))
 }
 
 // query uses writeQuery to recursively construct
 // a minified query string from the provided struct v.
 //
 // E.g., struct{Foo Int, BarBaz *Boolean} -> "{foo,barBaz}".
-func query(v interface{}) string {
+func query(v interface{}) (string, error) {
+	query, _, err := queryFields(v)
+	return query, err
+}
+
+// queryFields constructs the query for v like query, and returns the position of each field in it.
+func queryFields(v interface{}) (string, []fieldPosition, error) {
 	var buf bytes.Buffer
-	seen := make(map[string]struct{})
-	writeQuery(&buf, reflect.TypeOf(v), false, "")
-	fmt.Println(seen)
-	return buf.String()
+	st := newQueryState()
+	if err := writeQuery(&buf, reflect.TypeOf(v), false, "", st); err != nil {
+		return "", nil, err
+	}
+
+	// fragment definitions are appended after the operation, in order
+	bases := map[string]int{"": 0}
+	base := buf.Len()
+	for _, name := range st.fragments.names {
+		bases[name] = base
+		base += len(st.fragments.definitions[name])
+	}
+	for i := range st.positions {
+		st.positions[i].offset += bases[st.positions[i].fragment]
+	}
+
+	st.fragments.writeDefinitions(&buf)
+	return buf.String(), st.positions, nil
+}
+
+// fieldPosition is the position of the field written for a Go struct field.
+type fieldPosition struct {
+	fragment string // the fragment definition containing the field, if any
+	offset   int
+	field    string // path of the Go struct field, e.g. "Viewer.Login"
+}
+
+// queryState is the state of constructing a query.
+type queryState struct {
+	fragments *fragmentSet
+	maxDepth  int
+	// types counts the struct types being expanded, to detect cycles
+	types map[reflect.Type]int
+	// fields counts the fields with a depth tag being expanded
+	fields map[fieldKey]int
+
+	// the fragment definition being written, and the path of Go struct fields within it
+	fragment  string
+	path      []string
+	positions []fieldPosition
+}
+
+// fieldKey identifies a struct field.
+type fieldKey struct {
+	t     reflect.Type
+	index int
+}
+
+func newQueryState() *queryState {
+	return &queryState{
+		fragments: newFragmentSet(),
+		maxDepth:  int(atomic.LoadInt32(&maxDepth)),
+		types:     make(map[reflect.Type]int),
+		fields:    make(map[fieldKey]int),
+	}
+}
+
+// Fragment marks a struct type as a named fragment. Instead of expanding the struct everywhere it's used,
+// the query spreads the fragment, e.g. "...UserFields", and defines it once after the operation,
+// e.g. "fragment UserFields on User{name,email}". Embedded fragment structs are spread into the parent selection.
+type Fragment interface {
+	// GraphQLFragment returns the fragment name and the type condition, e.g. "UserFields", "User".
+	GraphQLFragment() (name string, on string)
+}
+
+var fragmentType = reflect.TypeOf((*Fragment)(nil)).Elem()
+
+// fragmentOf returns the fragment name and type condition if t implements Fragment.
+func fragmentOf(t reflect.Type) (name, on string, ok bool) {
+	var v reflect.Value
+	switch {
+	case t.Implements(fragmentType):
+		v = reflect.Zero(t)
+	case reflect.PtrTo(t).Implements(fragmentType):
+		v = reflect.New(t)
+	default:
+		return "", "", false
+	}
+	name, on = v.Interface().(Fragment).GraphQLFragment()
+
+	// the method may be promoted from an embedded fragment, which doesn't make t a fragment itself
+	if t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.Anonymous {
+				if embedded, _, ok := fragmentOf(f.Type); ok && embedded == name {
+					return "", "", false
+				}
+			}
+		}
+	}
+	return name, on, true
+}
+
+// fragmentSet collects the fragment definitions of a query, in order of first use.
+type fragmentSet struct {
+	names       []string
+	definitions map[string]string
+	inProgress  map[string]bool
+}
+
+func newFragmentSet() *fragmentSet {
+	return &fragmentSet{
+		definitions: make(map[string]string),
+		inProgress:  make(map[string]bool),
+	}
+}
+
+// spread writes the fragment spread for struct type t to w, defining the fragment on first use.
+// It returns false if t isn't a fragment, is used within its own definition, or has the inverse field
+// skipped at this use, where it's expanded instead.
+func (st *queryState) spread(w *bytes.Buffer, t reflect.Type, inverseName string) (bool, error) {
+	fs := st.fragments
+	name, on, ok := fragmentOf(t)
+	if !ok || fs.inProgress[name] || hasSelection(t, inverseName) {
+		return false, nil
+	}
+	if _, ok := fs.definitions[name]; !ok {
+		// the definition is the same wherever the fragment is used, so its depth and fields don't depend on the first use
+		types, fields, fragment, path := st.types, st.fields, st.fragment, st.path
+		st.types, st.fields = make(map[reflect.Type]int), make(map[fieldKey]int)
+		st.fragment, st.path = name, []string{t.Name()}
+		defer func() { st.types, st.fields, st.fragment, st.path = types, fields, fragment, path }()
+
+		fs.inProgress[name] = true
+		var buf bytes.Buffer
+		io.WriteString(&buf, "fragment "+name+" on "+on)
+		if err := writeQuery(&buf, t, false, "", st); err != nil {
+			return false, err
+		}
+		delete(fs.inProgress, name)
+		fs.names = append(fs.names, name)
+		fs.definitions[name] = buf.String()
+	}
+	io.WriteString(w, "..."+name)
+	return true, nil
+}
+
+// writeDefinitions appends the collected fragment definitions to w.
+func (fs *fragmentSet) writeDefinitions(w io.Writer) {
+	for _, name := range fs.names {
+		io.WriteString(w, fs.definitions[name])
+	}
 }
 
 // writeQuery writes a minified query for t to w.
 // If inline is true, the struct fields of t are inlined into parent struct.
-// Seen is used to stop infinite loops
-func writeQuery(w io.Writer, t reflect.Type, inline bool, inverseName string) {
+// Struct types implementing Fragment are spread, and their definitions collected in st.
+// Struct types nested in themselves more than the max depth fail, unless the recursive field
+// is bounded with the depth tag, which overrides the max depth, or the hasInverse tag.
+func writeQuery(w *bytes.Buffer, t reflect.Type, inline bool, inverseName string, st *queryState) error {
 	switch t.Kind() {
 	case reflect.Ptr, reflect.Slice:
-		writeQuery(w, t.Elem(), false, inverseName)
+		return writeQuery(w, t.Elem(), false, inverseName, st)
 	case reflect.Struct:
 		// If the type implements json.Unmarshaler, it's a scalar. Don't expand it.
 		if reflect.PtrTo(t).Implements(jsonUnmarshaler) {
-			return
+			return nil
 		}
-		if !inline {
+		if inline {
+			// embedded fragment, spread into the parent selection
+			if ok, err := st.spread(w, t, inverseName); ok || err != nil {
+				return err
+			}
+		} else {
 			io.WriteString(w, "{")
+			if ok, err := st.spread(w, t, inverseName); ok || err != nil {
+				io.WriteString(w, "}")
+				return err
+			}
 		}
+		st.types[t]++
+		defer func() { st.types[t]-- }()
+
+		aliases := jsonutil.AutoAliases(t)
+		written := 0
 		for i := 0; i < t.NumField(); i++ {
 			f := t.Field(i)
-			value, ok := f.Tag.Lookup("graphql")
-			if value == "-" {
+			_, ok := f.Tag.Lookup("graphql")
+			value, selected := selectionOf(f)
+			if !selected {
 				//skip (this is 'omit')
 				continue
-			} else if value == "" {
-				value = ident.ParseMixedCaps(f.Name).ToLowerCamelCase()
 			}
 			if inverseName == value {
 				continue //Don't allow recursion
 			}
 			thisInverseName, _ := f.Tag.Lookup("hasInverse")
-			// if thisInverseName != "" {
-			// 	fmt.Println()
-			// }
-			if i != 0 {
+
+			key := fieldKey{t, i}
+			tag, bounded := f.Tag.Lookup("depth")
+			if bounded {
+				depth, err := strconv.Atoi(tag)
+				if err != nil || depth < 0 {
+					return fmt.Errorf("graphql: invalid depth tag %q of field %v.%s", tag, t, f.Name)
+				}
+				if st.fields[key] >= depth {
+					// bounded recursive field
+					continue
+				}
+			}
+			// the depth tag overrides the max depth
+			if ft := selectionType(f.Type); !bounded && st.types[ft] > 0 && st.types[ft] >= st.maxDepth {
+				return fmt.Errorf("graphql: field %v.%s nests %v in itself more than %d times, bound it with a depth or hasInverse tag", t, f.Name, ft, st.maxDepth)
+			}
+
+			if written != 0 {
 				io.WriteString(w, ",")
 			}
+			written++
 			inlineField := f.Anonymous && !ok
+			st.path = append(st.path, f.Name)
 			if !inlineField {
+				st.positions = append(st.positions, fieldPosition{
+					fragment: st.fragment,
+					offset:   w.Len(),
+					field:    strings.Join(st.path, "."),
+				})
+				if alias, ok := aliases[i]; ok {
+					// the response key collides with another field
+					io.WriteString(w, alias+":")
+				}
 				io.WriteString(w, value)
 			}
-			writeQuery(w, f.Type, inlineField, thisInverseName)
+			st.fields[key]++
+			err := writeQuery(w, f.Type, inlineField, thisInverseName, st)
+			st.fields[key]--
+			st.path = st.path[:len(st.path)-1]
+			if err != nil {
+				return err
+			}
 		}
 		if !inline {
 			io.WriteString(w, "}")
 		}
 	}
+	return nil
+}
+
+// selectionOf returns the selection written for struct field f, and false if f is omitted.
+func selectionOf(f reflect.StructField) (string, bool) {
+	value := f.Tag.Get("graphql")
+	switch {
+	case value == "-":
+		return "", false
+	case value == "":
+		return ident.ParseMixedCaps(f.Name).ToLowerCamelCase(), true
+	case strings.HasPrefix(value, "@"):
+		// directives only, e.g. `graphql:"@include(if: $withDetails)"`
+		return ident.ParseMixedCaps(f.Name).ToLowerCamelCase() + " " + value, true
+	}
+	return value, true
+}
+
+// hasSelection reports whether struct type t has a field whose selection is inverseName.
+func hasSelection(t reflect.Type, inverseName string) bool {
+	if inverseName == "" {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if value, ok := selectionOf(t.Field(i)); ok && value == inverseName {
+			return true
+		}
+	}
+	return false
+}
+
+// selectionType returns the type whose fields are selected for a field of type t.
+func selectionType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t
 }
 
 var jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
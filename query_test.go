@@ -1,9 +1,13 @@
 package graphql
 
 import (
+	"encoding/json"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 func TestConstructQuery(t *testing.T) {
@@ -163,9 +167,9 @@ func TestConstructQuery(t *testing.T) {
 				} `graphql:"repository(owner: $repositoryOwner, name: $repositoryName)"`
 			}{},
 			inVariables: map[string]interface{}{
-				"repositoryOwner": NewString("shurcooL-test"),
-				"repositoryName":  NewString("test-repo"),
-				"issueNumber":     NewInt64(1),
+				"repositoryOwner": NewStringStruct("shurcooL-test"),
+				"repositoryName":  NewStringStruct("test-repo"),
+				"issueNumber":     NewInt64Struct(1),
 			},
 			want: `query ($issueNumber:Int!$repositoryName:String!$repositoryOwner:String!){repository(owner: $repositoryOwner, name: $repositoryName){issue(number: $issueNumber){body}}}`,
 		},
@@ -185,9 +189,9 @@ func TestConstructQuery(t *testing.T) {
 				} `graphql:"repository(owner: $repositoryOwner, name: $repositoryName)"`
 			}{},
 			inVariables: map[string]interface{}{
-				"repositoryOwner": NewString("shurcooL-test"),
-				"repositoryName":  NewString("test-repo"),
-				"issueNumber":     NewInt64(1),
+				"repositoryOwner": NewStringStruct("shurcooL-test"),
+				"repositoryName":  NewStringStruct("test-repo"),
+				"issueNumber":     NewInt64Struct(1),
 			},
 			want: `query SearchRepository($issueNumber:Int!$repositoryName:String!$repositoryOwner:String!){repository(owner: $repositoryOwner, name: $repositoryName){issue(number: $issueNumber){reactionGroups{users(first:10){nodes{login}}}}}}`,
 		},
@@ -232,7 +236,10 @@ func TestConstructQuery(t *testing.T) {
 		},
 	}
 	for _, tc := range tests {
-		got := constructQuery(tc.inV, tc.inVariables, tc.name)
+		got, err := constructQuery(tc.inV, tc.inVariables, tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if got != tc.want {
 			t.Errorf("\ngot:  %q\nwant: %q\n", got, tc.want)
 		}
@@ -267,7 +274,10 @@ func TestConstructMutation(t *testing.T) {
 		},
 	}
 	for _, tc := range tests {
-		got := constructMutation(tc.inV, tc.inVariables, "")
+		got, err := constructMutation(tc.inV, tc.inVariables, "")
+		if err != nil {
+			t.Fatal(err)
+		}
 		if got != tc.want {
 			t.Errorf("\ngot:  %q\nwant: %q\n", got, tc.want)
 		}
@@ -431,9 +441,9 @@ func TestConstructSubscription(t *testing.T) {
 				} `graphql:"repository(owner: $repositoryOwner, name: $repositoryName)"`
 			}{},
 			inVariables: map[string]interface{}{
-				"repositoryOwner": NewString("shurcooL-test"),
-				"repositoryName":  NewString("test-repo"),
-				"issueNumber":     NewInt64(1),
+				"repositoryOwner": NewStringStruct("shurcooL-test"),
+				"repositoryName":  NewStringStruct("test-repo"),
+				"issueNumber":     NewInt64Struct(1),
 			},
 			want: `subscription ($issueNumber:Int!$repositoryName:String!$repositoryOwner:String!){repository(owner: $repositoryOwner, name: $repositoryName){issue(number: $issueNumber){body}}}`,
 		},
@@ -453,9 +463,9 @@ func TestConstructSubscription(t *testing.T) {
 				} `graphql:"repository(owner: $repositoryOwner, name: $repositoryName)"`
 			}{},
 			inVariables: map[string]interface{}{
-				"repositoryOwner": NewString("shurcooL-test"),
-				"repositoryName":  NewString("test-repo"),
-				"issueNumber":     NewInt64(1),
+				"repositoryOwner": NewStringStruct("shurcooL-test"),
+				"repositoryName":  NewStringStruct("test-repo"),
+				"issueNumber":     NewInt64Struct(1),
 			},
 			want: `subscription SearchRepository($issueNumber:Int!$repositoryName:String!$repositoryOwner:String!){repository(owner: $repositoryOwner, name: $repositoryName){issue(number: $issueNumber){reactionGroups{users(first:10){nodes{login}}}}}}`,
 		},
@@ -500,7 +510,192 @@ func TestConstructSubscription(t *testing.T) {
 		},
 	}
 	for _, tc := range tests {
-		got := constructSubscription(tc.inV, tc.inVariables, tc.name)
+		got, err := constructSubscription(tc.inV, tc.inVariables, tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("\ngot:  %q\nwant: %q\n", got, tc.want)
+		}
+	}
+}
+
+func TestConstructQuery_directives(t *testing.T) {
+	type ID string
+	var q struct {
+		User struct {
+			Name    GqlString
+			Details struct {
+				Bio GqlString
+			} `graphql:"@include(if: $withDetails)"`
+			Posts []struct {
+				Title GqlString
+			} `graphql:"posts(first: 10) @skip(if: $noPosts)"`
+		} `graphql:"queryUser(filter: {id: $id}) @cascade"`
+	}
+	variables := map[string]interface{}{
+		"id":          ID("1"),
+		"withDetails": NewBoolStruct(true),
+		"noPosts":     NewBoolStruct(false),
+	}
+	want := `query ($id:ID!$noPosts:Boolean!$withDetails:Boolean!){queryUser(filter: {id: $id}) @cascade{name,details @include(if: $withDetails){bio},posts(first: 10) @skip(if: $noPosts){title}}}`
+	got, err := constructQuery(q, variables, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("\ngot:  %q\nwant: %q\n", got, want)
+	}
+}
+
+func TestConstructQuery_autoAliases(t *testing.T) {
+	var q struct {
+		ActiveUsers []struct {
+			Name GqlString
+		} `graphql:"queryUser(filter: {active: true})"`
+		BlockedUsers []struct {
+			Name GqlString
+		} `graphql:"queryUser(filter: {blocked: true})"`
+		Admins []struct {
+			Name GqlString
+		} `graphql:"admins: queryUser(filter: {admin: true})"`
+		Viewer struct {
+			Name GqlString
+		}
+		Active []struct {
+			Name GqlString
+		} `graphql:"activeUsers"`
+	}
+	want := `{activeUsers2:queryUser(filter: {active: true}){name},blockedUsers:queryUser(filter: {blocked: true}){name},admins: queryUser(filter: {admin: true}){name},viewer{name},activeUsers{name}}`
+	got, err := constructQuery(q, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("\ngot:  %q\nwant: %q\n", got, want)
+	}
+}
+
+func TestConstructQuery_variablesStruct(t *testing.T) {
+	var q struct {
+		User struct {
+			Name GqlString
+		} `graphql:"user(id: $id)"`
+		Posts []struct {
+			Title GqlString
+		} `graphql:"posts(first: $first, after: $after)"`
+	}
+	type variables struct {
+		ID     string  `graphql:"id,type=ID!"`
+		First  int     `graphql:",type=Int!"`
+		After  *string `graphql:"after,type=String"`
+		Ignore string  `graphql:"-"`
+	}
+	want := `query GetUser($after:String$first:Int!$id:ID!){user(id: $id){name},posts(first: $first, after: $after){title}}`
+	got, err := ConstructQuery(q, variables{ID: "1", First: 10}, "GetUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("\ngot:  %q\nwant: %q\n", got, want)
+	}
+
+	// The variables struct is encoded as the variables object.
+	vars, err := variablesMap(&variables{ID: "1", First: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"after":null,"first":10,"id":"1"}`; got != want {
+		t.Errorf("\ngot:  %s\nwant: %s\n", got, want)
+	}
+
+	if _, err := ConstructQuery(q, []string{"1"}, ""); err == nil {
+		t.Error("got nil error for variables of type []string")
+	}
+	if _, err := ConstructQuery(q, struct {
+		A string `graphql:"id"`
+		B string `graphql:"id"`
+	}{}, ""); err == nil {
+		t.Error("got nil error for duplicate variable names")
+	}
+}
+
+// userFields is a struct type reused as a named fragment.
+type userFields struct {
+	Name  GqlString
+	Email GqlString
+}
+
+func (userFields) GraphQLFragment() (string, string) { return "UserFields", "User" }
+
+// friendFields refers to its own type, which is expanded within the definition.
+type friendFields struct {
+	Name    GqlString
+	Friends []friendFields `hasInverse:"friends"`
+}
+
+func (*friendFields) GraphQLFragment() (string, string) { return "FriendFields", "User" }
+
+// accountFields has a field that's the inverse of another edge.
+type accountFields struct {
+	Name  GqlString
+	Owner *struct {
+		Name GqlString
+	}
+}
+
+func (accountFields) GraphQLFragment() (string, string) { return "AccountFields", "Account" }
+
+func TestConstructQuery_fragments(t *testing.T) {
+	tests := []struct {
+		inV  interface{}
+		want string
+	}{
+		{
+			inV: struct {
+				Viewer userFields
+				Post   struct {
+					Author    *userFields
+					Reviewers []userFields
+				}
+			}{},
+			want: `{viewer{...UserFields},post{author{...UserFields},reviewers{...UserFields}}}fragment UserFields on User{name,email}`,
+		},
+		{
+			inV: struct {
+				Viewer struct {
+					userFields
+					ID GqlString
+				}
+			}{},
+			want: `{viewer{...UserFields,id}}fragment UserFields on User{name,email}`,
+		},
+		{
+			inV: struct {
+				Viewer friendFields
+			}{},
+			want: `{viewer{...FriendFields}}fragment FriendFields on User{name,friends{name}}`,
+		},
+		{
+			// the inverse field is only skipped where the fragment is used below the inverse edge
+			inV: struct {
+				Pet struct {
+					Owner accountFields `hasInverse:"owner"`
+				}
+				Viewer accountFields
+			}{},
+			want: `{pet{owner{name}},viewer{...AccountFields}}fragment AccountFields on Account{name,owner{name}}`,
+		},
+	}
+	for _, tc := range tests {
+		got, err := constructQuery(tc.inV, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
 		if got != tc.want {
 			t.Errorf("\ngot:  %q\nwant: %q\n", got, tc.want)
 		}
@@ -514,7 +709,7 @@ func TestQueryArguments(t *testing.T) {
 	}{
 		{
 			in:   map[string]interface{}{"a": NewInt64(123), "b": NewBool(true)},
-			want: "$a:Int!$b:Boolean",
+			want: "$a:Int$b:Boolean",
 		},
 		{
 			in: map[string]interface{}{
@@ -539,19 +734,22 @@ func TestQueryArguments(t *testing.T) {
 		},
 		{
 			in:   map[string]interface{}{"id": "someID"},
-			want: "$id:ID!",
+			want: "$id:String!",
 		},
 		{
 			in:   map[string]interface{}{"ids": []*GqlString{NewString("someID"), NewString("anotherID")}},
-			want: `$ids:[ID!]!`,
+			want: `$ids:[String]!`,
 		},
 		{
 			in:   map[string]interface{}{"ids": &[]*GqlString{NewString("someID"), NewString("anotherID")}},
-			want: `$ids:[ID!]`,
+			want: `$ids:[String]`,
 		},
 	}
 	for i, tc := range tests {
-		got := queryArguments(tc.in, false) //todo:mm: not sure if I should have made this false
+		got, err := queryArguments(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if got != tc.want {
 			t.Errorf("test case %d:\n got: %q\nwant: %q", i, got, tc.want)
 		}
@@ -601,3 +799,249 @@ type AddReactionInput struct {
 	// A unique identifier for the client performing the mutation. (Optional.)
 	ClientMutationID *GqlString `json:"clientMutationId,omitempty"`
 }
+
+// userID declares its GraphQL type.
+type userID string
+
+func (userID) GraphQLType() string { return "ID" }
+
+// cursor declares its GraphQL type with a pointer receiver.
+type cursor struct{ value string }
+
+func (*cursor) GraphQLType() string { return "Cursor" }
+
+// tags is a named slice.
+type tags []string
+
+// objectID is registered, and isn't a list although it's an array.
+type objectID [12]byte
+
+func TestQueryArguments_types(t *testing.T) {
+	RegisterType(objectID{}, "ObjectID")
+
+	tests := []struct {
+		in   map[string]interface{}
+		want string
+	}{
+		{
+			in:   map[string]interface{}{"a": 1, "b": int64(2), "c": uint8(3), "d": 1.5, "e": true, "f": "s"},
+			want: "$a:Int!$b:Int!$c:Int!$d:Float!$e:Boolean!$f:String!",
+		},
+		{
+			in:   map[string]interface{}{"ids": []userID{"1"}, "after": &cursor{}, "id": objectID{}},
+			want: "$after:Cursor$id:ObjectID!$ids:[ID!]!",
+		},
+		{
+			in:   map[string]interface{}{"first": (*int)(nil), "tags": []string{"a"}},
+			want: "$first:Int$tags:[String!]!",
+		},
+		{
+			// named slices are lists
+			in:   map[string]interface{}{"tags": tags{"a"}},
+			want: "$tags:[String!]!",
+		},
+	}
+	for i, tc := range tests {
+		got, err := queryArguments(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("test case %d:\n got: %q\nwant: %q", i, got, tc.want)
+		}
+	}
+
+	for _, in := range []map[string]interface{}{
+		{"filter": map[string]interface{}{"name": "a"}},
+		{"input": struct{ Name string }{}},
+		{"id": nil},
+		{"c": complex(1, 2)},
+		{"id": uuid.UUID{}},
+		{"data": []byte("a")},
+		{"data": [4]byte{}},
+	} {
+		if got, err := queryArguments(in); err == nil {
+			t.Errorf("got %q and nil error for %v", got, in)
+		}
+	}
+}
+
+// doubledType declares an invalid type.
+type doubledType int
+
+func (doubledType) GraphQLType() string { return "Int!!" }
+
+func TestQueryArguments_nullability(t *testing.T) {
+	n := 1
+	tests := []struct {
+		in   map[string]interface{}
+		want string
+	}{
+		{
+			in:   map[string]interface{}{"b": NewBoolStruct(true), "f": NewFloat64Struct(1), "i": NewInt64Struct(1), "p": NewPointStruct(1, 2), "s": NewStringStruct("s"), "t": NewTimeStruct(time.Time{})},
+			want: "$b:Boolean!$f:Float!$i:Int!$p:PointRef!$s:String!$t:DateTime!",
+		},
+		{
+			in:   map[string]interface{}{"b": NewBool(true), "f": NewFloat64(1), "i": NewInt64(1), "p": NewPoint(1, 2), "s": NewString("s"), "t": NewTime(time.Time{})},
+			want: "$b:Boolean$f:Float$i:Int$p:PointRef$s:String$t:DateTime",
+		},
+		{
+			in:   map[string]interface{}{"ids": []*GqlString{NewString("1")}, "names": []GqlString{NewStringStruct("a")}},
+			want: "$ids:[String]!$names:[String!]!",
+		},
+		{
+			// the outermost marker wins
+			in:   map[string]interface{}{"a": NonNull(Nullable(1)), "b": Nullable(NonNull(NewInt64(1)))},
+			want: "$a:Int!$b:Int",
+		},
+		{
+			in:   map[string]interface{}{"a": NonNull(&n), "b": Nullable(n), "c": Nullable(NewInt64(1)), "d": NonNull([]*int{&n})},
+			want: "$a:Int!$b:Int$c:Int$d:[Int]!",
+		},
+		{
+			in:   map[string]interface{}{"input": &AddReactionInput{}, "ids": &[]*int{}},
+			want: "$ids:[Int]$input:AddReactionInput",
+		},
+	}
+	for i, tc := range tests {
+		got, err := queryArguments(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("test case %d:\n got: %q\nwant: %q", i, got, tc.want)
+		}
+	}
+
+	// The same rules apply to all operations.
+	q := struct{ Viewer struct{ Login GqlString } }{}
+	variables := map[string]interface{}{"input": &AddReactionInput{}}
+	for _, construct := range []func(interface{}, map[string]interface{}, string) (string, error){constructQuery, constructMutation, constructSubscription} {
+		got, err := construct(q, variables, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(got, "($input:AddReactionInput)") {
+			t.Errorf("got %q, want nullable $input", got)
+		}
+	}
+
+	if got := variableValues(map[string]interface{}{"a": NonNull(Nullable(1))})["a"]; got != 1 {
+		t.Errorf("got value %#v, want: 1", got)
+	}
+
+	vars, err := variablesMap(struct {
+		First int    `graphql:"first,nullable"`
+		After *int   `graphql:"after,nonnull"`
+		ID    string `graphql:"id,type=ID,nonnull"`
+	}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := queryArguments(vars); err != nil || got != "$after:Int!$first:Int$id:ID!" {
+		t.Errorf("got %q, %v, want: %q", got, err, "$after:Int!$first:Int$id:ID!")
+	}
+}
+
+func TestQueryArguments_invalidTypes(t *testing.T) {
+	for _, typ := range []string{"ID!!", "[ID!]!!", "[ID", "ID]", "", "!", "In t", "1D"} {
+		in := map[string]interface{}{"id": typedVariable{graphqlType: typ, value: "1"}}
+		if got, err := queryArguments(in); err == nil {
+			t.Errorf("got %q and nil error for type %q", got, typ)
+		}
+	}
+	if got, err := queryArguments(map[string]interface{}{"a": doubledType(1)}); err == nil {
+		t.Errorf("got %q and nil error for declared type Int!!", got)
+	}
+	for _, typ := range []string{"ID", "ID!", "[ID]", "[[ID!]!]!", "_Any"} {
+		in := map[string]interface{}{"id": typedVariable{graphqlType: typ, value: "1"}}
+		if _, err := queryArguments(in); err != nil {
+			t.Errorf("got error %v for type %q", err, typ)
+		}
+	}
+}
+
+// node is an unbounded recursive type.
+type node struct {
+	Name     GqlString
+	Children []node
+}
+
+// tree bounds its recursion with a depth tag.
+type tree struct {
+	Name     GqlString
+	Children []tree `depth:"2"`
+}
+
+// deepTree bounds its recursion deeper than the default max depth.
+type deepTree struct {
+	Name     GqlString
+	Children []deepTree `depth:"12"`
+}
+
+// person bounds its recursion with an inverse edge, declared before the other fields.
+type person struct {
+	Friends []person `hasInverse:"friends"`
+	Name    GqlString
+}
+
+// ping and pong are mutually recursive.
+type ping struct{ Pong *pong }
+type pong struct{ Ping *ping }
+
+func TestConstructQuery_recursive(t *testing.T) {
+	tests := []struct {
+		inV  interface{}
+		want string
+	}{
+		{
+			inV:  struct{ Root tree }{},
+			want: `{root{name,children{name,children{name}}}}`,
+		},
+		{
+			inV:  struct{ Viewer person }{},
+			want: `{viewer{friends{name},name}}`,
+		},
+	}
+	for _, tc := range tests {
+		got, err := constructQuery(tc.inV, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("\ngot:  %q\nwant: %q\n", got, tc.want)
+		}
+	}
+
+	for _, v := range []interface{}{
+		struct{ Root node }{},
+		struct{ Ping ping }{},
+		struct {
+			Root struct {
+				Children []tree `depth:"x"`
+			}
+		}{},
+	} {
+		if got, err := constructQuery(v, nil, ""); err == nil {
+			t.Errorf("got %q and nil error for %T", got, v)
+		}
+	}
+	_, err := constructQuery(struct{ Root node }{}, nil, "")
+	if want := "graphql: field graphql.node.Children nests graphql.node in itself more than 10 times, bound it with a depth or hasInverse tag"; err == nil || err.Error() != want {
+		t.Errorf("got error: %v, want: %s", err, want)
+	}
+
+	// the depth tag overrides the max depth
+	deep, err := constructQuery(struct{ Root deepTree }{}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(deep, "children"); got != 12 {
+		t.Errorf("got %d nested children in %q, want: 12", got, deep)
+	}
+	SetMaxDepth(1)
+	defer SetMaxDepth(10)
+	if got, err := constructQuery(struct{ Root tree }{}, nil, ""); err != nil || got != `{root{name,children{name,children{name}}}}` {
+		t.Errorf("got %q and error %v for a depth tag over the max depth", got, err)
+	}
+}
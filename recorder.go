@@ -0,0 +1,378 @@
+package graphql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// RecordedEventType is the kind of a recorded websocket event
+type RecordedEventType string
+
+const (
+	// RecordedConnect marks the start of a connection
+	RecordedConnect RecordedEventType = "connect"
+	// RecordedSend is a message sent by the client
+	RecordedSend RecordedEventType = "send"
+	// RecordedReceive is a message received from the server
+	RecordedReceive RecordedEventType = "receive"
+	// RecordedDisconnect is a connection failure, e.g. closed by the server
+	RecordedDisconnect RecordedEventType = "disconnect"
+	// RecordedClose marks the connection being closed by the client
+	RecordedClose RecordedEventType = "close"
+)
+
+// RecordedEvent is a line of a recording
+type RecordedEvent struct {
+	// Offset is the time since the recording started
+	Offset   time.Duration     `json:"offset"`
+	Type     RecordedEventType `json:"type"`
+	Protocol string            `json:"protocol,omitempty"`
+	Message  *OperationMessage `json:"message,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	// Status is the websocket close status of a disconnect event, if any
+	Status websocket.StatusCode `json:"status,omitempty"`
+}
+
+// Recorder writes the websocket traffic of a subscription client to w, one JSON event per line.
+// All connections of the client, including reconnections, are written to the same recording
+type Recorder struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	start time.Time
+	err   error
+}
+
+// NewRecorder creates a recorder writing to w, e.g. a file
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		enc:   json.NewEncoder(w),
+		start: time.Now(),
+	}
+}
+
+// WebSocket wraps the connections created by fn. If fn is nil, NewWebsocketConn is used.
+// The result can be passed to WithWebSocket
+func (r *Recorder) WebSocket(fn func(sc *SubscriptionClient) (WebsocketConn, error)) func(sc *SubscriptionClient) (WebsocketConn, error) {
+	if fn == nil {
+		fn = NewWebsocketConn
+	}
+	return func(sc *SubscriptionClient) (WebsocketConn, error) {
+		conn, err := fn(sc)
+		if err != nil {
+			return nil, err
+		}
+		event := RecordedEvent{Type: RecordedConnect}
+		if c, ok := conn.(interface{ Subprotocol() string }); ok {
+			event.Protocol = c.Subprotocol()
+		}
+		r.record(event)
+		return &recordingConn{WebsocketConn: conn, recorder: r, protocol: event.Protocol}, nil
+	}
+}
+
+// Err returns the first error of writing the recording
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(event RecordedEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	event.Offset = time.Since(r.start)
+	r.err = r.enc.Encode(event)
+}
+
+type recordingConn struct {
+	WebsocketConn
+	recorder *Recorder
+	protocol string
+}
+
+func (rc *recordingConn) WriteJSON(v interface{}) error {
+	msg, err := toOperationMessage(v)
+	if err != nil {
+		return err
+	}
+	rc.recorder.record(RecordedEvent{Type: RecordedSend, Message: &msg})
+	return rc.WebsocketConn.WriteJSON(v)
+}
+
+func (rc *recordingConn) ReadJSON(v interface{}) error {
+	if err := rc.WebsocketConn.ReadJSON(v); err != nil {
+		rc.recorder.record(RecordedEvent{Type: RecordedDisconnect, Error: err.Error(), Status: websocket.CloseStatus(err)})
+		return err
+	}
+	msg, err := toOperationMessage(v)
+	if err != nil {
+		return err
+	}
+	rc.recorder.record(RecordedEvent{Type: RecordedReceive, Message: &msg})
+	return nil
+}
+
+func (rc *recordingConn) Close() error {
+	rc.recorder.record(RecordedEvent{Type: RecordedClose})
+	return rc.WebsocketConn.Close()
+}
+
+// Subprotocol returns the subprotocol of the recorded connection, so the protocol can still be negotiated
+func (rc *recordingConn) Subprotocol() string {
+	return rc.protocol
+}
+
+func toOperationMessage(v interface{}) (OperationMessage, error) {
+	switch msg := v.(type) {
+	case OperationMessage:
+		return msg, nil
+	case *OperationMessage:
+		return *msg, nil
+	}
+	var msg OperationMessage
+	b, err := json.Marshal(v)
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(b, &msg)
+	return msg, err
+}
+
+// Replay plays back a recording created by Recorder. Each connection of the client replays the next recorded connection.
+// Received messages are played in order, once the client has sent the connection init and start messages
+// that preceded them in the recording. Start messages are matched by payload, i.e. query and variables,
+// whatever order the client sends them in, and operation IDs are mapped to the IDs of the replaying client
+type Replay struct {
+	// Speed multiplies the playback speed of the recorded timing. Zero plays the messages without delay
+	Speed float64
+
+	mu          sync.Mutex
+	connections [][]RecordedEvent
+	next        int
+}
+
+// NewReplay reads a recording from r
+func NewReplay(r io.Reader) (*Replay, error) {
+	replay := &Replay{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		if event.Type == RecordedConnect {
+			replay.connections = append(replay.connections, nil)
+		}
+		if len(replay.connections) == 0 {
+			return nil, fmt.Errorf("replay: %s event before connect", event.Type)
+		}
+		last := len(replay.connections) - 1
+		replay.connections[last] = append(replay.connections[last], event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+// WebSocket returns a connection replaying the next recorded connection. It can be passed to WithWebSocket
+func (r *Replay) WebSocket(sc *SubscriptionClient) (WebsocketConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next >= len(r.connections) {
+		return nil, fmt.Errorf("replay: no more recorded connections")
+	}
+	events := r.connections[r.next]
+	r.next++
+	return &replayConn{
+		events:   events,
+		protocol: events[0].Protocol,
+		speed:    r.Speed,
+		ids:      make(map[string]string),
+		changed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+type replayConn struct {
+	events   []RecordedEvent
+	protocol string
+	speed    float64
+
+	mu         sync.Mutex
+	pos        int                // next event to replay
+	lastOffset time.Duration      // offset of the last replayed message
+	sent       []OperationMessage // init and start messages sent by the client
+	matched    []bool             // sent messages matched to a recorded message
+	ids        map[string]string  // recorded operation ID to replaying ID
+	changed    chan struct{}      // closed and replaced when the client sends a message
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// gates reports whether msg must be sent by the client before the following received messages are replayed
+func gates(msg *OperationMessage) bool {
+	switch msg.Type {
+	case GQL_CONNECTION_INIT, GQL_START, GQL_SUBSCRIBE:
+		return true
+	}
+	return false
+}
+
+func (rc *replayConn) WriteJSON(v interface{}) error {
+	msg, err := toOperationMessage(v)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-rc.closed:
+		return fmt.Errorf("replay: connection closed")
+	default:
+	}
+	if !gates(&msg) {
+		return nil
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.sent = append(rc.sent, msg)
+	rc.matched = append(rc.matched, false)
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+	return nil
+}
+
+func (rc *replayConn) ReadJSON(v interface{}) error {
+	for {
+		rc.mu.Lock()
+		event, ok, wait := rc.nextEvent()
+		changed := rc.changed
+		rc.mu.Unlock()
+
+		if !ok {
+			// the recording ended while connected, wait for the client to close the connection
+			<-rc.closed
+			return websocket.CloseError{Code: websocket.StatusNormalClosure, Reason: "replay: connection closed"}
+		}
+		if wait {
+			select {
+			case <-changed:
+				continue
+			case <-rc.closed:
+				return websocket.CloseError{Code: websocket.StatusNormalClosure, Reason: "replay: connection closed"}
+			}
+		}
+
+		if rc.speed > 0 {
+			rc.mu.Lock()
+			delay := time.Duration(float64(event.Offset-rc.lastOffset) / rc.speed)
+			rc.lastOffset = event.Offset
+			rc.mu.Unlock()
+			select {
+			case <-time.After(delay):
+			case <-rc.closed:
+				return websocket.CloseError{Code: websocket.StatusNormalClosure, Reason: "replay: connection closed"}
+			}
+		}
+
+		if event.Type == RecordedDisconnect {
+			if event.Status > 0 {
+				return websocket.CloseError{Code: event.Status, Reason: event.Error}
+			}
+			return fmt.Errorf("replay: %s", event.Error)
+		}
+
+		msg := *event.Message
+		rc.mu.Lock()
+		if id, ok := rc.ids[msg.ID]; ok {
+			msg.ID = id
+		}
+		rc.mu.Unlock()
+
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, v)
+	}
+}
+
+// nextEvent returns the next received message or disconnect event, consuming it.
+// It reports whether the client has to send more messages first. Must be called with mu held
+func (rc *replayConn) nextEvent() (RecordedEvent, bool, bool) {
+	for rc.pos < len(rc.events) {
+		event := rc.events[rc.pos]
+		switch event.Type {
+		case RecordedSend:
+			if gates(event.Message) {
+				i := rc.match(event.Message)
+				if i < 0 {
+					return event, true, true
+				}
+				rc.matched[i] = true
+				// map the recorded operation ID to the ID sent by the client
+				if event.Message.ID != "" {
+					rc.ids[event.Message.ID] = rc.sent[i].ID
+				}
+			}
+		case RecordedReceive, RecordedDisconnect:
+			rc.pos++
+			return event, true, false
+		}
+		rc.pos++
+	}
+	return RecordedEvent{}, false, false
+}
+
+// match returns the index of the first unmatched message sent by the client that matches the recorded message,
+// or -1 if there is none. Connection init messages match whatever their payload, e.g. a refreshed token.
+// Must be called with mu held
+func (rc *replayConn) match(recorded *OperationMessage) int {
+	for i, msg := range rc.sent {
+		if rc.matched[i] || msg.Type != recorded.Type {
+			continue
+		}
+		if msg.Type == GQL_CONNECTION_INIT || samePayload(msg.Payload, recorded.Payload) {
+			return i
+		}
+	}
+	return -1
+}
+
+// samePayload reports whether the JSON payloads a and b are equal, regardless of formatting
+func samePayload(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func (rc *replayConn) Close() error {
+	rc.closeOnce.Do(func() {
+		close(rc.closed)
+	})
+	return nil
+}
+
+func (rc *replayConn) SetReadLimit(limit int64) {}
+
+// Subprotocol returns the recorded subprotocol
+func (rc *replayConn) Subprotocol() string {
+	return rc.protocol
+}
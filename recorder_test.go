@@ -0,0 +1,199 @@
+package graphql_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/machship-mm/go-graphql-client"
+	"github.com/machship-mm/go-graphql-client/graphqltest"
+	"nhooyr.io/websocket"
+)
+
+// subscribeCounts subscribes to counts and returns the received counts once the server completed the subscription
+// and the handler processed the want messages
+func subscribeCounts(t *testing.T, client *graphql.SubscriptionClient, want int) []int64 {
+	var sub struct {
+		Count graphql.GqlInt64
+	}
+	var mu sync.Mutex
+	var counts []int64
+	received := make(chan struct{}, want)
+	handle, err := client.SubscribeIntoWithContext(context.Background(), sub, nil, func(data interface{}, err error) error {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		mu.Lock()
+		counts = append(counts, data.(*struct{ Count graphql.GqlInt64 }).Count.Int64)
+		mu.Unlock()
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	select {
+	case <-handle.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for completion")
+	}
+	// wait for the handler to process the queued messages
+	for i := 0; i < want; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i+1)
+		}
+	}
+	_ = client.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	return counts
+}
+
+func TestRecorder(t *testing.T) {
+	for _, protocol := range []string{"graphql-ws", "graphql-transport-ws"} {
+		server := newSubscriptionServer(t, []string{protocol}, `{"data":{"count":1}}`, `{"data":{"count":2}}`)
+		server.closeStatus = map[int32]websocket.StatusCode{0: websocket.StatusTryAgainLater}
+
+		var recording bytes.Buffer
+		recorder := graphql.NewRecorder(&recording)
+		client := graphql.NewSubscriptionClient(server.wsURL()).
+			WithBackoff(graphql.ConstantBackoff{Interval: time.Millisecond}).
+			WithWebSocket(recorder.WebSocket(nil))
+		if got := subscribeCounts(t, client, 2); len(got) != 2 {
+			t.Fatalf("%s: got %v while recording, want 2 counts", protocol, got)
+		}
+		server.Close()
+		if err := recorder.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		var events []graphql.RecordedEvent
+		dec := json.NewDecoder(bytes.NewReader(recording.Bytes()))
+		for dec.More() {
+			var event graphql.RecordedEvent
+			if err := dec.Decode(&event); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, event)
+		}
+		if events[0].Type != graphql.RecordedConnect || events[0].Protocol != protocol {
+			t.Errorf("%s: got first event %+v, want connect", protocol, events[0])
+		}
+
+		replay, err := graphql.NewReplay(bytes.NewReader(recording.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		var states []graphql.ConnectionState
+		client = graphql.NewSubscriptionClient("ws://replay").
+			WithBackoff(graphql.ConstantBackoff{Interval: time.Millisecond}).
+			WithWebSocket(replay.WebSocket).
+			OnStateChange(func(change graphql.StateChange) {
+				mu.Lock()
+				states = append(states, change.To)
+				mu.Unlock()
+			})
+		got := subscribeCounts(t, client, 2)
+		if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+			t.Errorf("%s: got %v while replaying, want: [1 2]", protocol, got)
+		}
+		mu.Lock()
+		states = append([]graphql.ConnectionState(nil), states...)
+		mu.Unlock()
+		want := []graphql.ConnectionState{graphql.StateConnecting, graphql.StateReconnecting, graphql.StateConnected}
+		if len(states) < len(want) {
+			t.Fatalf("%s: got states %v, want: %v", protocol, states, want)
+		}
+		for i := range want {
+			if states[i] != want[i] {
+				t.Errorf("%s: got states %v, want: %v", protocol, states, want)
+				break
+			}
+		}
+	}
+}
+
+func TestReplay_subscriptions(t *testing.T) {
+	server := graphqltest.NewServer()
+	defer server.Close()
+	server.Handle(graphqltest.QueryContains("{a}")).Stream(`{"a":1}`)
+	server.Handle(graphqltest.QueryContains("{b}")).Stream(`{"b":2}`)
+
+	// subscribe receives the values of a and b, each from its own subscription
+	subscribe := func(client *graphql.SubscriptionClient) map[string]int64 {
+		var a struct{ A graphql.GqlInt64 }
+		var b struct{ B graphql.GqlInt64 }
+		var mu sync.Mutex
+		got := make(map[string]int64)
+		received := make(chan struct{}, 2)
+		record := func(key string, value int64) {
+			mu.Lock()
+			got[key] = value
+			mu.Unlock()
+			received <- struct{}{}
+		}
+		if _, err := client.SubscribeInto(a, nil, func(data interface{}, err error) error {
+			if err != nil {
+				t.Error(err)
+				return nil
+			}
+			record("a", data.(*struct{ A graphql.GqlInt64 }).A.Int64)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.SubscribeInto(b, nil, func(data interface{}, err error) error {
+			if err != nil {
+				t.Error(err)
+				return nil
+			}
+			record("b", data.(*struct{ B graphql.GqlInt64 }).B.Int64)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		go client.Run()
+		defer client.Close()
+		for i := 0; i < 2; i++ {
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the subscriptions")
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+
+	var recording bytes.Buffer
+	recorder := graphql.NewRecorder(&recording)
+	got := subscribe(graphql.NewSubscriptionClient(server.WebsocketURL()).WithWebSocket(recorder.WebSocket(nil)))
+	if got["a"] != 1 || got["b"] != 2 {
+		t.Fatalf("got %v while recording, want: map[a:1 b:2]", got)
+	}
+
+	// the subscriptions are started in random order, every replay must deliver the recorded payloads to the same handlers
+	for i := 0; i < 20; i++ {
+		replay, err := graphql.NewReplay(bytes.NewReader(recording.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := subscribe(graphql.NewSubscriptionClient("ws://replay").WithWebSocket(replay.WebSocket))
+		if got["a"] != 1 || got["b"] != 2 {
+			t.Fatalf("replay %d: got %v, want: map[a:1 b:2]", i, got)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	graphqlschema "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+)
+
+// Schema is a GraphQL schema that operations are validated against before they're sent,
+// see Client.WithSchema and SubscriptionClient.WithSchema.
+type Schema struct {
+	schema *graphqlschema.Schema
+}
+
+// ParseSchema parses a schema in the GraphQL schema definition language, e.g. the content of a schema.graphql file.
+// Custom scalars and directives used by operations must be declared.
+func ParseSchema(sdl string) (*Schema, error) {
+	s, err := graphqlschema.ParseSchema(sdl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{schema: s}, nil
+}
+
+// ParseIntrospection parses the result of the introspection query, with or without the "data" envelope.
+func ParseIntrospection(result []byte) (*Schema, error) {
+	sdl, err := introspectionSDL(result)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchema(sdl)
+}
+
+// ValidationError is an error of an operation that doesn't match the schema.
+type ValidationError struct {
+	Message string
+	// Field is the path of the Go struct field responsible, e.g. "Viewer.Login", if known.
+	// Fields of fragment definitions start with the fragment type, e.g. "userFields.Name".
+	Field  string
+	Line   int
+	Column int
+}
+
+// Error implements error interface.
+func (e *ValidationError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("graphql: %s (field %s)", e.Message, e.Field)
+	}
+	return fmt.Sprintf("graphql: %s (line %d, column %d)", e.Message, e.Line, e.Column)
+}
+
+// ValidationErrors are the errors of an operation that doesn't match the schema.
+type ValidationErrors []*ValidationError
+
+// Error implements error interface.
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate validates the operation against the schema: the fields and arguments exist,
+// the required arguments are present, and the variable types match their uses.
+// It returns ValidationErrors if the operation is invalid.
+func (s *Schema) Validate(operation string) error {
+	return s.validate(operation, nil)
+}
+
+// validate validates the operation constructed for v, if not nil, with errors pointing to the fields of v.
+func (s *Schema) validate(operation string, v interface{}) error {
+	var queryErrs []*gqlerrors.QueryError
+	for _, qe := range s.schema.Validate(operation) {
+		// the values of the variables are sent apart from the operation, and checked by the server
+		if qe.Rule != "VariablesOfCorrectType" {
+			queryErrs = append(queryErrs, qe)
+		}
+	}
+	if len(queryErrs) == 0 {
+		return nil
+	}
+
+	var positions []fieldPosition
+	if v != nil {
+		body, fields, err := queryFields(v)
+		if err == nil && strings.HasSuffix(operation, body) {
+			// the body follows the operation type, name and variable definitions
+			base := len(operation) - len(body)
+			for _, f := range fields {
+				f.offset += base
+				positions = append(positions, f)
+			}
+		}
+	}
+
+	errs := make(ValidationErrors, len(queryErrs))
+	for i, qe := range queryErrs {
+		err := &ValidationError{Message: qe.Message}
+		if len(qe.Locations) > 0 {
+			err.Line, err.Column = qe.Locations[0].Line, qe.Locations[0].Column
+			if err.Line == 1 {
+				err.Field = fieldAt(positions, err.Column-1)
+			}
+		}
+		errs[i] = err
+	}
+	return errs
+}
+
+// fieldAt returns the Go struct field of the last field starting at or before offset.
+func fieldAt(positions []fieldPosition, offset int) string {
+	field, start := "", -1
+	for _, p := range positions {
+		if p.offset <= offset && p.offset > start {
+			field, start = p.field, p.offset
+		}
+	}
+	return field
+}
+
+// introspection is the "__schema" of the introspection query result.
+type introspection struct {
+	QueryType        *struct{ Name string }
+	MutationType     *struct{ Name string }
+	SubscriptionType *struct{ Name string }
+	Types            []struct {
+		Kind          string
+		Name          string
+		Fields        []introspectionField
+		InputFields   []introspectionInputValue
+		Interfaces    []struct{ Name string }
+		EnumValues    []struct{ Name string }
+		PossibleTypes []struct{ Name string }
+	}
+	Directives []struct {
+		Name      string
+		Locations []string
+		Args      []introspectionInputValue
+	}
+}
+
+type introspectionField struct {
+	Name string
+	Args []introspectionInputValue
+	Type introspectionTypeRef
+}
+
+type introspectionInputValue struct {
+	Name         string
+	Type         introspectionTypeRef
+	DefaultValue *string
+}
+
+type introspectionTypeRef struct {
+	Kind   string
+	Name   string
+	OfType *introspectionTypeRef
+}
+
+// String returns the type reference, e.g. "[ID!]!".
+func (t introspectionTypeRef) String() string {
+	switch {
+	case t.Kind == "NON_NULL" && t.OfType != nil:
+		return t.OfType.String() + "!"
+	case t.Kind == "LIST" && t.OfType != nil:
+		return "[" + t.OfType.String() + "]"
+	}
+	return t.Name
+}
+
+// builtins are defined by every schema.
+var builtins = map[string]bool{
+	"Int": true, "Float": true, "String": true, "Boolean": true, "ID": true,
+	"include": true, "skip": true, "deprecated": true, "specifiedBy": true,
+}
+
+// introspectionSDL converts the introspection query result to the schema definition language.
+func introspectionSDL(result []byte) (string, error) {
+	var out struct {
+		Data *struct {
+			Schema *introspection `json:"__schema"`
+		}
+		Schema *introspection `json:"__schema"`
+	}
+	if err := json.Unmarshal(result, &out); err != nil {
+		return "", err
+	}
+	schema := out.Schema
+	if out.Data != nil && out.Data.Schema != nil {
+		schema = out.Data.Schema
+	}
+	if schema == nil {
+		return "", fmt.Errorf("graphql: no __schema in introspection result")
+	}
+
+	var b strings.Builder
+	b.WriteString("schema {\n")
+	if schema.QueryType != nil {
+		b.WriteString("  query: " + schema.QueryType.Name + "\n")
+	}
+	if schema.MutationType != nil {
+		b.WriteString("  mutation: " + schema.MutationType.Name + "\n")
+	}
+	if schema.SubscriptionType != nil {
+		b.WriteString("  subscription: " + schema.SubscriptionType.Name + "\n")
+	}
+	b.WriteString("}\n")
+
+	for _, t := range schema.Types {
+		if builtins[t.Name] || strings.HasPrefix(t.Name, "__") {
+			continue
+		}
+		switch t.Kind {
+		case "SCALAR":
+			b.WriteString("scalar " + t.Name + "\n")
+		case "OBJECT", "INTERFACE":
+			keyword := "type "
+			if t.Kind == "INTERFACE" {
+				keyword = "interface "
+			}
+			b.WriteString(keyword + t.Name)
+			for i, iface := range t.Interfaces {
+				if i == 0 {
+					b.WriteString(" implements ")
+				} else {
+					b.WriteString(" & ")
+				}
+				b.WriteString(iface.Name)
+			}
+			b.WriteString(" {\n")
+			for _, f := range t.Fields {
+				b.WriteString("  " + f.Name + inputValuesSDL(f.Args) + ": " + f.Type.String() + "\n")
+			}
+			b.WriteString("}\n")
+		case "UNION":
+			names := make([]string, len(t.PossibleTypes))
+			for i, p := range t.PossibleTypes {
+				names[i] = p.Name
+			}
+			b.WriteString("union " + t.Name + " = " + strings.Join(names, " | ") + "\n")
+		case "ENUM":
+			b.WriteString("enum " + t.Name + " {\n")
+			for _, v := range t.EnumValues {
+				b.WriteString("  " + v.Name + "\n")
+			}
+			b.WriteString("}\n")
+		case "INPUT_OBJECT":
+			b.WriteString("input " + t.Name + " {\n")
+			for _, f := range t.InputFields {
+				b.WriteString("  " + inputValueSDL(f) + "\n")
+			}
+			b.WriteString("}\n")
+		default:
+			return "", fmt.Errorf("graphql: unknown kind %q of type %s in introspection result", t.Kind, t.Name)
+		}
+	}
+
+	for _, d := range schema.Directives {
+		if builtins[d.Name] {
+			continue
+		}
+		locations := append([]string(nil), d.Locations...)
+		sort.Strings(locations)
+		b.WriteString("directive @" + d.Name + inputValuesSDL(d.Args) + " on " + strings.Join(locations, " | ") + "\n")
+	}
+	return b.String(), nil
+}
+
+// inputValuesSDL returns the argument definitions, e.g. "(first: Int = 10, after: String)".
+func inputValuesSDL(args []introspectionInputValue) string {
+	if len(args) == 0 {
+		return ""
+	}
+	defs := make([]string, len(args))
+	for i, arg := range args {
+		defs[i] = inputValueSDL(arg)
+	}
+	return "(" + strings.Join(defs, ", ") + ")"
+}
+
+func inputValueSDL(v introspectionInputValue) string {
+	def := v.Name + ": " + v.Type.String()
+	if v.DefaultValue != nil {
+		def += " = " + *v.DefaultValue
+	}
+	return def
+}
@@ -0,0 +1,161 @@
+package graphql_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	graphqlschema "github.com/graph-gophers/graphql-go"
+	graphql "github.com/machship-mm/go-graphql-client"
+)
+
+const testSchema = `
+scalar DateTime
+
+directive @cascade on FIELD
+
+type Query {
+	user(id: ID!): User
+	users(first: Int = 10): [User!]!
+}
+
+type Mutation {
+	addUser(name: String!): User
+}
+
+type User {
+	id: ID!
+	name: String!
+	email: String
+	createdAt: DateTime
+	friends(first: Int): [User!]!
+}
+`
+
+// BadUserFields is a fragment with a misspelled field.
+type BadUserFields struct {
+	Nme graphql.GqlString
+}
+
+func (BadUserFields) GraphQLFragment() (string, string) { return "BadUserFields", "User" }
+
+func TestSchema_validate(t *testing.T) {
+	schema, err := graphql.ParseSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	introspected, err := graphqlschema.MustParseSchema(testSchema, nil).ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromIntrospection, err := graphql.ParseIntrospection([]byte(`{"data":` + string(introspected) + `}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type user struct {
+		Name      graphql.GqlString
+		CreatedAt graphql.GqlTime
+		Friends   []struct {
+			Email graphql.GqlString
+		} `graphql:"friends(first: 5) @cascade"`
+	}
+	tests := []struct {
+		q         interface{}
+		variables interface{}
+		wantField string
+		wantErr   string
+	}{
+		{
+			q: struct {
+				User user `graphql:"user(id: $id)"`
+			}{},
+			variables: struct {
+				ID string `graphql:"id,type=ID!"`
+			}{"1"},
+		},
+		{
+			q: struct {
+				User struct {
+					Nme graphql.GqlString
+				} `graphql:"user(id: $id)"`
+			}{},
+			variables: struct {
+				ID string `graphql:"id,type=ID!"`
+			}{"1"},
+			wantField: "User.Nme",
+			wantErr:   `Cannot query field "nme" on type "User".`,
+		},
+		{
+			q: struct {
+				Users []struct {
+					Friends []struct {
+						Name graphql.GqlString
+					} `graphql:"friends(last: 1)"`
+				}
+			}{},
+			wantField: "Users.Friends",
+			wantErr:   `Unknown argument "last" on field "friends" of type "User".`,
+		},
+		{
+			q: struct {
+				User struct {
+					Name graphql.GqlString
+				}
+			}{},
+			wantField: "User",
+			wantErr:   `Field "user" argument "id" of type "ID!" is required but not provided.`,
+		},
+		{
+			q: struct {
+				User struct {
+					Name graphql.GqlString
+				} `graphql:"user(id: $id)"`
+			}{},
+			variables: map[string]interface{}{"id": 1},
+			wantErr:   `Variable "$id" of type "Int!" used in position expecting type "ID!".`,
+		},
+		{
+			q: struct {
+				Users []struct {
+					BadUserFields
+				}
+			}{},
+			wantField: "BadUserFields.Nme",
+			wantErr:   `Cannot query field "nme" on type "User".`,
+		},
+	}
+	for _, s := range []*graphql.Schema{schema, fromIntrospection} {
+		for i, tc := range tests {
+			client := graphql.NewClient("/graphql", &http.Client{Transport: localRoundTripper{handler: http.NotFoundHandler()}}).WithSchema(s)
+			err := client.Query(context.Background(), tc.q, tc.variables)
+			if tc.wantErr == "" {
+				// valid operations are sent
+				if err == nil || !strings.Contains(err.Error(), "non-200 OK status code") {
+					t.Errorf("test case %d: got error: %v, want the request to be sent", i, err)
+				}
+				continue
+			}
+			var errs graphql.ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Errorf("test case %d: got error: %v, want ValidationErrors", i, err)
+				continue
+			}
+			if got := errs[0].Message; !strings.HasPrefix(got, tc.wantErr) {
+				t.Errorf("test case %d: got message: %s, want: %s", i, got, tc.wantErr)
+			}
+			if tc.wantField != "" && errs[0].Field != tc.wantField {
+				t.Errorf("test case %d: got field: %q, want: %q", i, errs[0].Field, tc.wantField)
+			}
+		}
+	}
+
+	if err := schema.Validate(`mutation{addUser{id}}`); err == nil {
+		t.Error("got nil error for a missing required argument")
+	}
+	if err := schema.Validate(`mutation{addUser(name: "Ada"){id,name}}`); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,19 +3,32 @@ package graphql
 import (
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
-	"io"
-	"strings"
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/machship-mm/go-graphql-client/internal/jsonutil"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
 
 // Subscription transport follow Apollo's subscriptions-transport-ws protocol specification
 // https://github.com/apollographql/subscriptions-transport-ws/blob/master/PROTOCOL.md
+// or the newer graphql-transport-ws protocol specification
+// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+
+// SubscriptionProtocolType is the websocket subprotocol spoken by the subscription client
+type SubscriptionProtocolType string
+
+const (
+	// SubscriptionsTransportWS is the legacy Apollo subscriptions-transport-ws protocol
+	SubscriptionsTransportWS SubscriptionProtocolType = "graphql-ws"
+	// GraphQLTransportWS is the newer graphql-transport-ws protocol
+	GraphQLTransportWS SubscriptionProtocolType = "graphql-transport-ws"
+)
 
 // OperationMessageType
 type OperationMessageType string
@@ -48,6 +61,107 @@ const (
 	GQL_INTERNAL OperationMessageType = "internal"
 )
 
+// graphql-transport-ws message types. connection_init, connection_ack, error and complete are shared with the legacy protocol
+const (
+	// Client sends this message to execute GraphQL operation, replacing GQL_START
+	GQL_SUBSCRIBE OperationMessageType = "subscribe"
+	// The server sends this message to transfer the GraphQL execution result, replacing GQL_DATA
+	GQL_NEXT OperationMessageType = "next"
+	// Either side may send this message at any time to check the connection is alive. The receiver must respond with GQL_PONG
+	GQL_PING OperationMessageType = "ping"
+	// The response to GQL_PING. May also be sent unidirectionally as a heartbeat
+	GQL_PONG OperationMessageType = "pong"
+)
+
+// Close codes used by graphql-transport-ws servers to report protocol errors
+const (
+	StatusInternalServerError             websocket.StatusCode = 4500
+	StatusBadRequest                      websocket.StatusCode = 4400
+	StatusUnauthorized                    websocket.StatusCode = 4401
+	StatusForbidden                       websocket.StatusCode = 4403
+	StatusSubprotocolNotAcceptable        websocket.StatusCode = 4406
+	StatusConnectionInitialisationTimeout websocket.StatusCode = 4408
+	StatusSubscriberAlreadyExists         websocket.StatusCode = 4409
+	StatusTooManyInitialisationRequests   websocket.StatusCode = 4429
+)
+
+var (
+	// ErrConnectionReset is the reason of reconnecting after Reset is called,
+	// and the error of queries and mutations over the websocket whose connection ended before they completed
+	ErrConnectionReset = fmt.Errorf("connection reset")
+	// ErrKeepAliveTimeout is the reason of reconnecting when no message was received within the keep-alive timeout
+	ErrKeepAliveTimeout = fmt.Errorf("keep-alive timeout")
+	// ErrQueueFull is reported to the OnError event when a message is dropped with the OverflowError policy
+	ErrQueueFull = fmt.Errorf("subscription queue is full")
+)
+
+// ConnectionState is the state of the websocket connection of a subscription client
+type ConnectionState int
+
+const (
+	// StateIdle means the client isn't running, or has no connection in lazy mode
+	StateIdle ConnectionState = iota
+	// StateConnecting means the client is opening the connection
+	StateConnecting
+	// StateConnected means the server acknowledged the connection
+	StateConnected
+	// StateReconnecting means the connection failed or was lost, and the client is connecting again
+	StateReconnecting
+	// StateClosed means the client was closed and can't be used anymore
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// StateChange describes a transition of the connection state
+type StateChange struct {
+	From ConnectionState
+	To   ConnectionState
+	// Cause is the error that caused the transition, if any
+	Cause error
+	// Attempt is the connection attempt in progress, starting at 1. It's zero when idle or closed
+	Attempt int
+	Time    time.Time
+}
+
+// OverflowPolicy decides what happens to a message when the queue of its subscription is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until the handler catches up. No messages are lost,
+	// but a slow handler stops the client from reading the connection
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued message to make room for the new one
+	OverflowDropOldest
+	// OverflowDropNewest discards the new message
+	OverflowDropNewest
+	// OverflowError discards the new message and reports ErrQueueFull to the OnError event
+	OverflowError
+)
+
+// ConnectionError is the reason of reconnecting when the server rejects the connection with a GQL_CONNECTION_ERROR message
+type ConnectionError struct {
+	Payload json.RawMessage
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("connection rejected: %s", e.Payload)
+}
+
 type OperationMessage struct {
 	ID      string               `json:"id,omitempty"`
 	Type    OperationMessageType `json:"type"`
@@ -75,32 +189,124 @@ type WebsocketConn interface {
 
 type handlerFunc func(data *json.RawMessage, err error) error
 type subscription struct {
+	id        string
 	query     string
 	variables map[string]interface{}
-	handler   func(data *json.RawMessage, err error)
-	started   bool
+	payload   json.RawMessage
+	construct func(variables map[string]interface{}) (string, error) // builds the query for the variables
+	starts    int                                                    // number of times the subscription was started
+	single    bool                                                   // single result operation, never restarted
+	onRestart func(variables map[string]interface{}) map[string]interface{}
+	handler   handlerFunc
+	queue     chan delivery  // messages waiting for the handler, in order of arrival
+	pending   sync.WaitGroup // messages queued or being handled. Only the Run goroutine adds to it
+	done      chan struct{}
+	drained   chan struct{} // closed when the handler has processed all messages after done
+	err       error
+}
+
+// delivery is a message queued for a subscription handler
+type delivery struct {
+	data *json.RawMessage
+	err  error
+}
+
+// SubscriptionHandle manages the lifecycle of a subscription started with a context
+type SubscriptionHandle struct {
+	id  string
+	sc  *SubscriptionClient
+	sub *subscription
+}
+
+// ID returns the subscription ID
+func (sh *SubscriptionHandle) ID() string {
+	return sh.id
+}
+
+// Unsubscribe sends stop message to server and removes the subscription. It does nothing if the subscription is already done
+func (sh *SubscriptionHandle) Unsubscribe() error {
+	select {
+	case <-sh.sub.done:
+		return nil
+	default:
+	}
+	return sh.sc.Unsubscribe(sh.id)
+}
+
+// Done returns a channel that is closed when the subscription ends,
+// because it was unsubscribed, its context was canceled, the server completed it or the client was closed
+func (sh *SubscriptionHandle) Done() <-chan struct{} {
+	return sh.sub.done
+}
+
+// OnRestart sets a hook that computes the variables of the subscription before it's restarted on a new connection,
+// e.g. to resume from the last received event. It receives the variables of the previous start.
+// Variables declared by a variables struct keep their GraphQL types.
+// The hook is called once the handler has processed every message received before the restart,
+// so state recorded by the handler, such as a cursor, is up to date. Until then, the client doesn't read the new connection.
+// The hook is called from the Run goroutine, so access to state shared with the handler must be synchronized
+func (sh *SubscriptionHandle) OnRestart(fn func(variables map[string]interface{}) map[string]interface{}) *SubscriptionHandle {
+	sh.sc.mu.Lock()
+	sh.sub.onRestart = fn
+	sh.sc.mu.Unlock()
+	return sh
+}
+
+// Err returns the context error if the subscription ended because its context was canceled,
+// ErrConnectionReset if it's a query or mutation whose connection ended, nil otherwise
+func (sh *SubscriptionHandle) Err() error {
+	select {
+	case <-sh.sub.done:
+		return sh.sub.err
+	default:
+		return nil
+	}
 }
 
 // SubscriptionClient is a GraphQL subscription client.
+// The websocket connection is owned by the goroutine calling Run. Other methods send commands to it,
+// and a dedicated goroutine writes outgoing messages, so the client is safe for concurrent use.
+// Options must be set before calling Run. Event callbacks are called from the Run goroutine,
+// so they mustn't call Close synchronously
 type SubscriptionClient struct {
-	url              string
-	conn             WebsocketConn
-	connectionParams map[string]interface{}
-	context          context.Context
-	subscriptions    map[string]*subscription
-	cancel           context.CancelFunc
-	subscribersMu    sync.Mutex
-	timeout          time.Duration
-	isRunning        bool
-	readLimit        int64 // max size of response message. Default 10 MB
-	log              func(args ...interface{})
-	createConn       func(sc *SubscriptionClient) (WebsocketConn, error)
-	retryTimeout     time.Duration
-	onConnected      func()
-	onDisconnected   func()
-	onError          func(sc *SubscriptionClient, err error) error
-	errorChan        chan error
-	disabledLogTypes []OperationMessageType
+	url                string
+	connectionParams   map[string]interface{}
+	connectionParamsFn func(ctx context.Context) (map[string]interface{}, error)
+	timeout            time.Duration
+	readLimit          int64 // max size of response message. Default 10 MB
+	log                func(args ...interface{})
+	createConn         func(sc *SubscriptionClient) (WebsocketConn, error)
+	retryTimeout       time.Duration
+	onConnected        func()
+	onDisconnected     func()
+	onError            func(sc *SubscriptionClient, err error) error
+	disabledLogTypes   []OperationMessageType
+	prettyLog          bool
+	schema             *Schema
+	protocol           SubscriptionProtocolType // configured protocol. Negotiated with the server if empty
+	backoff            Backoff
+	retryCondition     func(sc *SubscriptionClient, err error) bool
+	keepAliveTimeout   time.Duration
+	pingInterval       time.Duration
+	onKeepAliveTimeout func()
+	queueSize          int
+	overflowPolicy     OverflowPolicy
+	workers            chan struct{} // limits concurrent handlers if not nil
+	lazy               bool
+	idleTimeout        time.Duration
+	onStateChange      func(change StateChange)
+	commands           chan command
+
+	mu            sync.Mutex // guards the fields below
+	subscriptions map[string]*subscription
+	context       context.Context
+	cancel        context.CancelFunc
+	connProtocol  SubscriptionProtocolType // protocol of the current connection
+	state         ConnectionState
+	running       bool
+	connecting    bool
+	closed        bool
+	runDone       chan struct{} // closed when Run returns
 }
 
 func NewSubscriptionClient(url string) *SubscriptionClient {
@@ -109,9 +315,10 @@ func NewSubscriptionClient(url string) *SubscriptionClient {
 		timeout:       time.Minute,
 		readLimit:     10 * 1024 * 1024, // set default limit 10MB
 		subscriptions: make(map[string]*subscription),
-		createConn:    newWebsocketConn,
+		createConn:    NewWebsocketConn,
 		retryTimeout:  time.Minute,
-		errorChan:     make(chan error),
+		queueSize:     100,
+		commands:      make(chan command),
 	}
 }
 
@@ -122,6 +329,8 @@ func (sc *SubscriptionClient) GetURL() string {
 
 // GetContext returns current context of subscription client
 func (sc *SubscriptionClient) GetContext() context.Context {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
 	return sc.context
 }
 
@@ -130,6 +339,25 @@ func (sc *SubscriptionClient) GetTimeout() time.Duration {
 	return sc.timeout
 }
 
+// GetProtocol returns the protocol of the current connection.
+// Before connecting, it returns the configured protocol, which is empty when the protocol is negotiated with the server
+func (sc *SubscriptionClient) GetProtocol() SubscriptionProtocolType {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.connProtocol != "" {
+		return sc.connProtocol
+	}
+	return sc.protocol
+}
+
+// GetSubprotocols returns the websocket subprotocols offered to the server when dialing
+func (sc *SubscriptionClient) GetSubprotocols() []string {
+	if sc.protocol != "" {
+		return []string{string(sc.protocol)}
+	}
+	return []string{string(SubscriptionsTransportWS), string(GraphQLTransportWS)}
+}
+
 // WithWebSocket replaces customized websocket client constructor
 // In default, subscription client uses https://github.com/nhooyr/websocket
 func (sc *SubscriptionClient) WithWebSocket(fn func(sc *SubscriptionClient) (WebsocketConn, error)) *SubscriptionClient {
@@ -138,12 +366,28 @@ func (sc *SubscriptionClient) WithWebSocket(fn func(sc *SubscriptionClient) (Web
 }
 
 // WithConnectionParams updates connection params for sending to server through GQL_CONNECTION_INIT event
-// It's usually used for authentication handshake
+// It's usually used for authentication handshake. Use WithConnectionParamsFn for credentials that expire
 func (sc *SubscriptionClient) WithConnectionParams(params map[string]interface{}) *SubscriptionClient {
 	sc.connectionParams = params
 	return sc
 }
 
+// WithConnectionParamsFn sets a function providing connection params, invoked with the connection context on every connection attempt,
+// so that fresh credentials such as short-lived tokens are sent when reconnecting. It takes precedence over WithConnectionParams
+// If the server rejects the credentials, the client reconnects with params from a new call.
+// Call Reset to re-authenticate a live connection, e.g. before a token expires
+func (sc *SubscriptionClient) WithConnectionParamsFn(fn func(ctx context.Context) (map[string]interface{}, error)) *SubscriptionClient {
+	sc.connectionParamsFn = fn
+	return sc
+}
+
+// WithProtocol sets the subscription protocol explicitly.
+// By default, both protocols are offered and the one chosen by the server is used
+func (sc *SubscriptionClient) WithProtocol(protocol SubscriptionProtocolType) *SubscriptionClient {
+	sc.protocol = protocol
+	return sc
+}
+
 // WithTimeout updates write timeout of websocket client
 func (sc *SubscriptionClient) WithTimeout(timeout time.Duration) *SubscriptionClient {
 	sc.timeout = timeout
@@ -151,11 +395,40 @@ func (sc *SubscriptionClient) WithTimeout(timeout time.Duration) *SubscriptionCl
 }
 
 // WithRetryTimeout updates reconnecting timeout. When the websocket server was stopped, the client will retry connecting every second until timeout
+// The timeout is ignored if a backoff strategy is set with WithBackoff
 func (sc *SubscriptionClient) WithRetryTimeout(timeout time.Duration) *SubscriptionClient {
 	sc.retryTimeout = timeout
 	return sc
 }
 
+// WithBackoff sets the strategy deciding how long to wait between connection attempts, and when to give up
+func (sc *SubscriptionClient) WithBackoff(backoff Backoff) *SubscriptionClient {
+	sc.backoff = backoff
+	return sc
+}
+
+// WithRetryCondition sets a function deciding whether to reconnect after the connection failed with err, e.g. to stop on authentication failures
+// If the function returns false, the client stops and Run returns the error
+// By default, the client stops on graphql-transport-ws close codes that reconnecting won't fix, such as 4401 Unauthorized
+func (sc *SubscriptionClient) WithRetryCondition(fn func(sc *SubscriptionClient, err error) bool) *SubscriptionClient {
+	sc.retryCondition = fn
+	return sc
+}
+
+// WithKeepAlive enables keep-alive monitoring. The client reconnects if no message is received within timeout,
+// counting from the first keep-alive message with subscriptions-transport-ws, or from the first message with graphql-transport-ws
+func (sc *SubscriptionClient) WithKeepAlive(timeout time.Duration) *SubscriptionClient {
+	sc.keepAliveTimeout = timeout
+	return sc
+}
+
+// WithPingInterval makes the client send ping messages to the server at the given interval.
+// Only graphql-transport-ws supports pings, the interval is ignored with subscriptions-transport-ws
+func (sc *SubscriptionClient) WithPingInterval(interval time.Duration) *SubscriptionClient {
+	sc.pingInterval = interval
+	return sc
+}
+
 // WithLog sets loging function to print out received messages. By default, nothing is printed
 func (sc *SubscriptionClient) WithLog(logger func(args ...interface{})) *SubscriptionClient {
 	sc.log = logger
@@ -168,6 +441,19 @@ func (sc *SubscriptionClient) WithoutLogTypes(types ...OperationMessageType) *Su
 	return sc
 }
 
+// WithPrettyLog logs the operation of start messages as an indented, multi-line document instead of the minified payload
+func (sc *SubscriptionClient) WithPrettyLog() *SubscriptionClient {
+	sc.prettyLog = true
+	return sc
+}
+
+// WithSchema validates the operations against schema before they're sent.
+// Invalid operations fail with ValidationErrors, which point to the Go struct fields responsible
+func (sc *SubscriptionClient) WithSchema(schema *Schema) *SubscriptionClient {
+	sc.schema = schema
+	return sc
+}
+
 // WithReadLimit set max size of response message
 func (sc *SubscriptionClient) WithReadLimit(limit int64) *SubscriptionClient {
 	sc.readLimit = limit
@@ -194,49 +480,324 @@ func (sc *SubscriptionClient) OnDisconnected(fn func()) *SubscriptionClient {
 	return sc
 }
 
-func (sc *SubscriptionClient) setIsRunning(value bool) {
-	sc.subscribersMu.Lock()
-	sc.isRunning = value
-	sc.subscribersMu.Unlock()
+// OnKeepAliveTimeout event is triggered when no message was received within the keep-alive timeout, before reconnecting
+func (sc *SubscriptionClient) OnKeepAliveTimeout(fn func()) *SubscriptionClient {
+	sc.onKeepAliveTimeout = fn
+	return sc
+}
+
+// OnStateChange event is triggered when the connection state changes
+// It's called from the goroutine that changed the state, so it mustn't block
+func (sc *SubscriptionClient) OnStateChange(fn func(change StateChange)) *SubscriptionClient {
+	sc.onStateChange = fn
+	return sc
 }
 
-func (sc *SubscriptionClient) init() error {
+// State returns the current connection state
+func (sc *SubscriptionClient) State() ConnectionState {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.state
+}
 
-	now := time.Now()
-	ctx, cancel := context.WithCancel(context.Background())
-	sc.context = ctx
-	sc.cancel = cancel
+// setState changes the connection state and triggers the OnStateChange event.
+// Once Close is called, the only remaining transition is to the final closed state
+func (sc *SubscriptionClient) setState(state ConnectionState, cause error, attempt int) {
+	sc.mu.Lock()
+	if sc.state == StateClosed || (sc.closed && state != StateClosed) {
+		sc.mu.Unlock()
+		return
+	}
+	change := StateChange{
+		From:    sc.state,
+		To:      state,
+		Cause:   cause,
+		Attempt: attempt,
+		Time:    time.Now(),
+	}
+	sc.state = state
+	sc.mu.Unlock()
+
+	if sc.onStateChange != nil {
+		sc.onStateChange(change)
+	}
+}
 
+// WithQueueSize sets the number of messages buffered for each subscription while its handler is busy. Default 100
+func (sc *SubscriptionClient) WithQueueSize(size int) *SubscriptionClient {
+	sc.queueSize = size
+	return sc
+}
+
+// WithOverflowPolicy sets what happens to a message when the queue of its subscription is full. Default OverflowBlock.
+// With OverflowBlock, the client stops reading while a queue is full, so handlers mustn't wait for the client:
+// Subscribe, Unsubscribe and Reset are safe to call from a handler, but Close, Query, Mutate and their variants
+// must be called from another goroutine
+func (sc *SubscriptionClient) WithOverflowPolicy(policy OverflowPolicy) *SubscriptionClient {
+	sc.overflowPolicy = policy
+	return sc
+}
+
+// WithMaxConcurrentHandlers limits the number of handlers running at the same time across all subscriptions.
+// Zero means no limit
+func (sc *SubscriptionClient) WithMaxConcurrentHandlers(n int) *SubscriptionClient {
+	if n > 0 {
+		sc.workers = make(chan struct{}, n)
+	} else {
+		sc.workers = nil
+	}
+	return sc
+}
+
+// WithLazyConnect enables the lazy connection mode. The client connects when the first subscription starts,
+// and closes the connection when there has been no subscription for the idle timeout.
+// Run is started by the first subscription, so calling it is optional
+func (sc *SubscriptionClient) WithLazyConnect(idleTimeout time.Duration) *SubscriptionClient {
+	sc.lazy = true
+	sc.idleTimeout = idleTimeout
+	return sc
+}
+
+// commandType is the kind of request sent to the Run goroutine
+type commandType int
+
+const (
+	cmdSubscribe commandType = iota
+	cmdUnsubscribe
+	cmdError
+	cmdReset
+	cmdClose
+)
+
+type command struct {
+	kind   commandType
+	sub    *subscription
+	subs   []*subscription // subscriptions to stop when closing
+	err    error
+	result chan error
+}
+
+// postCommand sends cmd to the Run goroutine without waiting for it to be received.
+// Handlers call Subscribe, Unsubscribe and Reset this way while the Run goroutine may be waiting for them
+// to make room in their queue with OverflowBlock
+func (sc *SubscriptionClient) postCommand(cmd command) {
+	select {
+	case sc.commands <- cmd:
+	default:
+		go sc.sendCommand(cmd)
+	}
+}
+
+// sendCommand sends cmd to the Run goroutine. It returns false if Run isn't running
+func (sc *SubscriptionClient) sendCommand(cmd command) bool {
+	sc.mu.Lock()
+	running, runDone := sc.running, sc.runDone
+	sc.mu.Unlock()
+	if !running {
+		return false
+	}
+	select {
+	case sc.commands <- cmd:
+		return true
+	case <-runDone:
+		return false
+	}
+}
+
+// connection is a single websocket connection, owned by the Run goroutine
+// The reader and writer goroutines only access conn and the channels
+type connection struct {
+	conn       WebsocketConn
+	protocol   SubscriptionProtocolType
+	cancel     context.CancelFunc
+	acked      bool
+	attempt    int
+	started    map[string]bool // subscriptions started on this connection
+	reads      chan readResult
+	writes     chan OperationMessage
+	writeErr   chan error
+	writerDone chan struct{}
+	done       chan struct{} // closed when the connection is closed, stops the reader
+}
+
+type readResult struct {
+	message OperationMessage
+	err     error
+}
+
+// readLoop reads messages from the websocket until it fails
+func (c *connection) readLoop() {
 	for {
-		var err error
-		var conn WebsocketConn
-		// allow custom websocket client
-		if sc.conn == nil {
-			conn, err = newWebsocketConn(sc)
-			if err == nil {
-				sc.conn = conn
-			}
+		var message OperationMessage
+		err := c.conn.ReadJSON(&message)
+		select {
+		case c.reads <- readResult{message: message, err: err}:
+		case <-c.done:
+			return
 		}
-
-		if err == nil {
-			sc.conn.SetReadLimit(sc.readLimit)
-			// send connection init event to the server
-			err = sc.sendConnectionInit()
+		// keep reading after invalid messages, the next read fails if the connection was closed
+		if err != nil && !isDecodeError(err) {
+			return
 		}
+	}
+}
 
-		if err == nil {
-			return nil
+// writeLoop writes queued messages to the websocket until the writes channel is closed
+func (c *connection) writeLoop() {
+	defer close(c.writerDone)
+	for msg := range c.writes {
+		if err := c.conn.WriteJSON(msg); err != nil {
+			select {
+			case c.writeErr <- err:
+			default:
+			}
 		}
+	}
+}
 
-		if now.Add(sc.retryTimeout).Before(time.Now()) {
-			if sc.onDisconnected != nil {
-				sc.onDisconnected()
-			}
-			return err
+// write queues msg for the writer goroutine
+func (sc *SubscriptionClient) write(c *connection, msg OperationMessage) {
+	if sc.prettyLog && (msg.Type == GQL_START || msg.Type == GQL_SUBSCRIBE) {
+		sc.printLog(prettyMessage(msg), msg.Type)
+	} else {
+		sc.printLog(msg, msg.Type)
+	}
+	c.writes <- msg
+}
+
+// prettyMessage formats the start message msg with its operation pretty-printed, for the log
+func prettyMessage(msg OperationMessage) interface{} {
+	var payload struct {
+		Query     string          `json:"query"`
+		Variables json.RawMessage `json:"variables"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return msg
+	}
+	message := fmt.Sprintf("%s %s\n%s", msg.Type, msg.ID, PrettyPrint(payload.Query))
+	if len(payload.Variables) > 0 {
+		message += "\nvariables: " + string(payload.Variables)
+	}
+	return message
+}
+
+// connect opens the websocket connection, sends connection init event to the server, and starts the reader and writer
+func (sc *SubscriptionClient) connect() (*connection, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.mu.Lock()
+	sc.context = ctx
+	sc.cancel = cancel
+	sc.connecting = true
+	sc.mu.Unlock()
+
+	defer func() {
+		sc.mu.Lock()
+		sc.connecting = false
+		sc.mu.Unlock()
+	}()
+
+	// allow custom websocket client
+	conn, err := sc.createConn(sc)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	protocol := negotiatedProtocol(sc, conn)
+	sc.mu.Lock()
+	sc.connProtocol = protocol
+	sc.mu.Unlock()
+
+	conn.SetReadLimit(sc.readLimit)
+	// send connection init event to the server
+	if err := sc.sendConnectionInit(ctx, conn); err != nil {
+		_ = conn.Close()
+		cancel()
+		return nil, err
+	}
+
+	c := &connection{
+		conn:       conn,
+		protocol:   protocol,
+		cancel:     cancel,
+		started:    make(map[string]bool),
+		reads:      make(chan readResult),
+		writes:     make(chan OperationMessage, 64),
+		writeErr:   make(chan error, 1),
+		writerDone: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.writeLoop()
+	return c, nil
+}
+
+// closeConnection sends stop message for the given subscriptions that were started on c, terminates and closes the connection.
+// It waits for queued messages to be written, and returns the error of closing the websocket
+func (sc *SubscriptionClient) closeConnection(c *connection, subs []*subscription) error {
+	for _, sub := range subs {
+		sc.stopSubscription(c, sub)
+	}
+	sc.terminate(c)
+	close(c.writes)
+	<-c.writerDone
+
+	err := c.conn.Close()
+	close(c.done)
+	c.cancel()
+	return err
+}
+
+// abortConnection closes a broken connection without sending any message
+func (sc *SubscriptionClient) abortConnection(c *connection) {
+	// closing the websocket first unblocks pending writes
+	_ = c.conn.Close()
+	close(c.writes)
+	<-c.writerDone
+	close(c.done)
+	c.cancel()
+}
+
+func (sc *SubscriptionClient) isClosed() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.closed
+}
+
+func (sc *SubscriptionClient) getBackoff() Backoff {
+	if sc.backoff != nil {
+		return sc.backoff
+	}
+	// retry every second until retry timeout
+	return BackoffFunc(func(attempt int, elapsed time.Duration) (time.Duration, bool) {
+		return time.Second, elapsed <= sc.retryTimeout
+	})
+}
+
+// shouldRetry reports whether the client should reconnect after err
+// Authentication failures are only retried when connection params are refreshed on every attempt
+func (sc *SubscriptionClient) shouldRetry(err error) bool {
+	if sc.retryCondition != nil {
+		return sc.retryCondition(sc, err)
+	}
+	if isAuthError(err) {
+		return sc.connectionParamsFn != nil
+	}
+	return !isFatalCloseStatus(websocket.CloseStatus(err))
+}
+
+// negotiatedProtocol returns the subprotocol chosen by the server,
+// falling back to the configured protocol, or the legacy protocol if none was configured
+func negotiatedProtocol(sc *SubscriptionClient, conn WebsocketConn) SubscriptionProtocolType {
+	if c, ok := conn.(interface{ Subprotocol() string }); ok {
+		switch p := SubscriptionProtocolType(c.Subprotocol()); p {
+		case SubscriptionsTransportWS, GraphQLTransportWS:
+			return p
 		}
-		sc.printLog(err.Error()+". retry in second....", GQL_INTERNAL)
-		time.Sleep(time.Second)
 	}
+	if sc.protocol != "" {
+		return sc.protocol
+	}
+	return SubscriptionsTransportWS
 }
 
 func (sc *SubscriptionClient) printLog(message interface{}, opType OperationMessageType) {
@@ -252,11 +813,19 @@ func (sc *SubscriptionClient) printLog(message interface{}, opType OperationMess
 	sc.log(message)
 }
 
-func (sc *SubscriptionClient) sendConnectionInit() (err error) {
+func (sc *SubscriptionClient) sendConnectionInit(ctx context.Context, conn WebsocketConn) (err error) {
+	params := sc.connectionParams
+	if sc.connectionParamsFn != nil {
+		params, err = sc.connectionParamsFn(ctx)
+		if err != nil {
+			return
+		}
+	}
+
 	var bParams []byte = nil
-	if sc.connectionParams != nil {
+	if params != nil {
 
-		bParams, err = json.Marshal(sc.connectionParams)
+		bParams, err = json.Marshal(params)
 		if err != nil {
 			return
 		}
@@ -269,150 +838,857 @@ func (sc *SubscriptionClient) sendConnectionInit() (err error) {
 	}
 
 	sc.printLog(msg, GQL_CONNECTION_INIT)
-	return sc.conn.WriteJSON(msg)
+	return conn.WriteJSON(msg)
 }
 
 // Subscribe sends start message to server and open a channel to receive data.
 // The handler callback function will receive raw message data or error. If the call return error, onError event will be triggered
 // The function returns subscription ID and error. You can use subscription ID to unsubscribe the subscription
-func (sc *SubscriptionClient) Subscribe(v interface{}, variables map[string]interface{}, handler func(message *json.RawMessage, err error) error) (string, error) {
-	return sc.do(v, variables, handler, "")
+// variables is a map[string]interface{}, or a struct with fields tagged with the variable names and types, e.g. `graphql:"id,type=ID!"`
+func (sc *SubscriptionClient) Subscribe(v interface{}, variables interface{}, handler func(message *json.RawMessage, err error) error) (string, error) {
+	return subscriptionID(sc.do(context.Background(), v, variables, handler, ""))
 }
 
 // NamedSubscribe sends start message to server and open a channel to receive data, with operation name
-func (sc *SubscriptionClient) NamedSubscribe(name string, v interface{}, variables map[string]interface{}, handler func(message *json.RawMessage, err error) error) (string, error) {
-	return sc.do(v, variables, handler, name)
+func (sc *SubscriptionClient) NamedSubscribe(name string, v interface{}, variables interface{}, handler func(message *json.RawMessage, err error) error) (string, error) {
+	return subscriptionID(sc.do(context.Background(), v, variables, handler, name))
 }
 
-func (sc *SubscriptionClient) do(v interface{}, variables map[string]interface{}, handler func(message *json.RawMessage, err error) error, name string) (string, error) {
-	id := uuid.New().String()
-	query := constructSubscription(v, variables, name)
+// SubscribeWithContext sends start message to server and open a channel to receive data.
+// Canceling ctx sends stop message to server and removes the subscription.
+// The returned handle can be used to unsubscribe and to wait for the subscription to end
+func (sc *SubscriptionClient) SubscribeWithContext(ctx context.Context, v interface{}, variables interface{}, handler func(message *json.RawMessage, err error) error) (*SubscriptionHandle, error) {
+	return sc.do(ctx, v, variables, handler, "")
+}
 
-	sub := subscription{
-		query:     query,
-		variables: variables,
-		handler:   sc.wrapHandler(handler),
+// NamedSubscribeWithContext sends start message to server and open a channel to receive data, with operation name.
+// Canceling ctx sends stop message to server and removes the subscription
+func (sc *SubscriptionClient) NamedSubscribeWithContext(ctx context.Context, name string, v interface{}, variables interface{}, handler func(message *json.RawMessage, err error) error) (*SubscriptionHandle, error) {
+	return sc.do(ctx, v, variables, handler, name)
+}
+
+// SubscribeInto sends start message to server and decodes every received data payload into a new value of v's type.
+// The handler receives a pointer to the decoded value, e.g. *T when v is T or *T, or the error.
+// Decoding errors are passed to the handler as well. If the call return error, onError event will be triggered
+func (sc *SubscriptionClient) SubscribeInto(v interface{}, variables interface{}, handler func(data interface{}, err error) error) (string, error) {
+	return subscriptionID(sc.do(context.Background(), v, variables, decodeHandler(v, handler), ""))
+}
+
+// NamedSubscribeInto sends start message to server and decodes every received data payload into a new value of v's type, with operation name
+func (sc *SubscriptionClient) NamedSubscribeInto(name string, v interface{}, variables interface{}, handler func(data interface{}, err error) error) (string, error) {
+	return subscriptionID(sc.do(context.Background(), v, variables, decodeHandler(v, handler), name))
+}
+
+// SubscribeIntoWithContext is like SubscribeInto, but the subscription is removed when ctx is canceled
+func (sc *SubscriptionClient) SubscribeIntoWithContext(ctx context.Context, v interface{}, variables interface{}, handler func(data interface{}, err error) error) (*SubscriptionHandle, error) {
+	return sc.do(ctx, v, variables, decodeHandler(v, handler), "")
+}
+
+// NamedSubscribeIntoWithContext is like NamedSubscribeInto, but the subscription is removed when ctx is canceled
+func (sc *SubscriptionClient) NamedSubscribeIntoWithContext(ctx context.Context, name string, v interface{}, variables interface{}, handler func(data interface{}, err error) error) (*SubscriptionHandle, error) {
+	return sc.do(ctx, v, variables, decodeHandler(v, handler), name)
+}
+
+// SubscribeChan sends start message to server and sends every decoded data payload to ch.
+// ch must be a channel of v's type T, or of *T. Errors, including decoding errors, trigger the onError event
+func (sc *SubscriptionClient) SubscribeChan(v interface{}, variables interface{}, ch interface{}) (string, error) {
+	return subscriptionID(sc.NamedSubscribeChanWithContext(context.Background(), "", v, variables, ch))
+}
+
+// NamedSubscribeChan sends start message to server and sends every decoded data payload to ch, with operation name
+func (sc *SubscriptionClient) NamedSubscribeChan(name string, v interface{}, variables interface{}, ch interface{}) (string, error) {
+	return subscriptionID(sc.NamedSubscribeChanWithContext(context.Background(), name, v, variables, ch))
+}
+
+// SubscribeChanWithContext is like SubscribeChan, but the subscription is removed when ctx is canceled
+func (sc *SubscriptionClient) SubscribeChanWithContext(ctx context.Context, v interface{}, variables interface{}, ch interface{}) (*SubscriptionHandle, error) {
+	return sc.NamedSubscribeChanWithContext(ctx, "", v, variables, ch)
+}
+
+// NamedSubscribeChanWithContext is like NamedSubscribeChan, but the subscription is removed when ctx is canceled
+func (sc *SubscriptionClient) NamedSubscribeChanWithContext(ctx context.Context, name string, v interface{}, variables interface{}, ch interface{}) (*SubscriptionHandle, error) {
+	handler, err := chanHandler(v, ch)
+	if err != nil {
+		return nil, err
 	}
+	return sc.do(ctx, v, variables, decodeHandler(v, handler), name)
+}
 
-	// if the websocket client is running, start subscription immediately
-	if sc.isRunning {
-		if err := sc.startSubscription(id, &sub); err != nil {
-			return "", err
+// subscriptionID returns the ID of the subscription handle, for functions that don't expose the handle
+func subscriptionID(sh *SubscriptionHandle, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	return sh.ID(), nil
+}
+
+// decodeHandler wraps handler into a raw message handler that decodes data into a new value of v's type
+func decodeHandler(v interface{}, handler func(data interface{}, err error) error) func(message *json.RawMessage, err error) error {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return func(message *json.RawMessage, err error) error {
+		if err != nil {
+			return handler(nil, err)
+		}
+		out := reflect.New(t)
+		if message != nil {
+			if err := jsonutil.UnmarshalGraphQL(*message, out.Interface()); err != nil {
+				return handler(nil, err)
+			}
 		}
+		return handler(out.Interface(), nil)
+	}
+}
+
+// chanHandler returns a decoded data handler that sends values to the channel ch
+func chanHandler(v interface{}, ch interface{}) (func(data interface{}, err error) error, error) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	cv := reflect.ValueOf(ch)
+	if cv.Kind() != reflect.Chan || cv.Type().ChanDir()&reflect.SendDir == 0 {
+		return nil, fmt.Errorf("expected a send channel, got %T", ch)
 	}
+	elem := cv.Type().Elem()
+	if elem != t && elem != reflect.PtrTo(t) {
+		return nil, fmt.Errorf("channel of type %v can't receive values of type %v", elem, t)
+	}
+	return func(data interface{}, err error) error {
+		if err != nil {
+			return err
+		}
+		value := reflect.ValueOf(data)
+		if elem == t {
+			value = value.Elem()
+		}
+		cv.Send(value)
+		return nil
+	}, nil
+}
 
-	sc.subscribersMu.Lock()
-	sc.subscriptions[id] = &sub
-	sc.subscribersMu.Unlock()
+// Query executes a single GraphQL query request over the websocket connection,
+// with a query derived from q, populating the response into it.
+// q should be a pointer to struct that corresponds to the GraphQL schema.
+// The client must be running, or use the lazy connection mode
+func (sc *SubscriptionClient) Query(ctx context.Context, q interface{}, variables interface{}) error {
+	return sc.execInto(ctx, queryOperation, q, variables, "")
+}
+
+// NamedQuery executes a single GraphQL query request over the websocket connection, with operation name
+func (sc *SubscriptionClient) NamedQuery(ctx context.Context, name string, q interface{}, variables interface{}) error {
+	return sc.execInto(ctx, queryOperation, q, variables, name)
+}
+
+// Mutate executes a single GraphQL mutation request over the websocket connection,
+// with a mutation derived from m, populating the response into it.
+// m should be a pointer to struct that corresponds to the GraphQL schema.
+// The client must be running, or use the lazy connection mode
+func (sc *SubscriptionClient) Mutate(ctx context.Context, m interface{}, variables interface{}) error {
+	return sc.execInto(ctx, mutationOperation, m, variables, "")
+}
+
+// NamedMutate executes a single GraphQL mutation request over the websocket connection, with operation name
+func (sc *SubscriptionClient) NamedMutate(ctx context.Context, name string, m interface{}, variables interface{}) error {
+	return sc.execInto(ctx, mutationOperation, m, variables, name)
+}
 
-	return id, nil
+// QueryRaw executes a single GraphQL query request over the websocket connection,
+// with a query derived from q. return raw bytes message.
+func (sc *SubscriptionClient) QueryRaw(ctx context.Context, q interface{}, variables interface{}) (*json.RawMessage, error) {
+	return sc.exec(ctx, queryOperation, q, variables, "")
 }
 
-// Subscribe sends start message to server and open a channel to receive data
-func (sc *SubscriptionClient) startSubscription(id string, sub *subscription) error {
-	if sub == nil || sub.started {
+// NamedQueryRaw executes a single GraphQL query request over the websocket connection, with operation name
+// return raw bytes message.
+func (sc *SubscriptionClient) NamedQueryRaw(ctx context.Context, name string, q interface{}, variables interface{}) (*json.RawMessage, error) {
+	return sc.exec(ctx, queryOperation, q, variables, name)
+}
+
+// MutateRaw executes a single GraphQL mutation request over the websocket connection,
+// with a mutation derived from m. return raw bytes message.
+func (sc *SubscriptionClient) MutateRaw(ctx context.Context, m interface{}, variables interface{}) (*json.RawMessage, error) {
+	return sc.exec(ctx, mutationOperation, m, variables, "")
+}
+
+// NamedMutateRaw executes a single GraphQL mutation request over the websocket connection, with operation name
+// return raw bytes message.
+func (sc *SubscriptionClient) NamedMutateRaw(ctx context.Context, name string, m interface{}, variables interface{}) (*json.RawMessage, error) {
+	return sc.exec(ctx, mutationOperation, m, variables, name)
+}
+
+// validate validates the operation constructed for v if the client has a schema
+func (sc *SubscriptionClient) validate(query string, v interface{}) error {
+	if sc.schema == nil {
 		return nil
 	}
+	return sc.schema.validate(query, v)
+}
 
+// execInto executes a single result operation and unmarshal json into v
+func (sc *SubscriptionClient) execInto(ctx context.Context, op operationType, v interface{}, variables interface{}, name string) error {
+	data, err := sc.exec(ctx, op, v, variables, name)
+	if data != nil {
+		if err := jsonutil.UnmarshalGraphQL(*data, v); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// exec executes a single result operation. It waits for the result and the completion of the operation
+func (sc *SubscriptionClient) exec(ctx context.Context, op operationType, v interface{}, variables interface{}, name string) (*json.RawMessage, error) {
+	construct := func(variables map[string]interface{}) (query string, err error) {
+		if op == mutationOperation {
+			query, err = constructMutation(v, variables, name)
+		} else {
+			query, err = constructQuery(v, variables, name)
+		}
+		if err != nil {
+			return "", err
+		}
+		return query, sc.validate(query, v)
+	}
+
+	type result struct {
+		data *json.RawMessage
+		err  error
+	}
+	results := make(chan result, 1)
+	handle, err := sc.start(ctx, construct, variables, true, func(data *json.RawMessage, err error) error {
+		// only the first result matters
+		select {
+		case results <- result{data: data, err: err}:
+		default:
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-results:
+		// wait for the server to complete the operation
+		select {
+		case <-handle.Done():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return r.data, r.err
+	case <-handle.sub.drained:
+		// the result is queued before the operation is drained, both may be ready
+		select {
+		case r := <-results:
+			return r.data, r.err
+		default:
+		}
+		if err := handle.Err(); err != nil {
+			return nil, err
+		}
+		if sc.isClosed() {
+			return nil, fmt.Errorf("subscription client is closed")
+		}
+		return nil, fmt.Errorf("operation %s completed without result", handle.ID())
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (sc *SubscriptionClient) do(ctx context.Context, v interface{}, variables interface{}, handler func(message *json.RawMessage, err error) error, name string) (*SubscriptionHandle, error) {
+	construct := func(variables map[string]interface{}) (string, error) {
+		query, err := constructSubscription(v, variables, name)
+		if err != nil {
+			return "", err
+		}
+		return query, sc.validate(query, v)
+	}
+	return sc.start(ctx, construct, variables, false, handler)
+}
+
+// start registers the operation and sends start message to server if the client is connected.
+// Single result operations are sent once, and fail if their connection ends before they complete
+func (sc *SubscriptionClient) start(ctx context.Context, construct func(variables map[string]interface{}) (string, error), vars interface{}, single bool, handler func(message *json.RawMessage, err error) error) (*SubscriptionHandle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	variables, err := variablesMap(vars)
+	if err != nil {
+		return nil, err
+	}
+	id := uuid.New().String()
+	query, err := construct(variables)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := operationPayload(query, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{
+		id:        id,
+		query:     query,
+		variables: variables,
+		payload:   payload,
+		construct: construct,
+		single:    single,
+		handler:   handler,
+		queue:     make(chan delivery, sc.queueSize),
+		done:      make(chan struct{}),
+		drained:   make(chan struct{}),
+	}
+
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return nil, fmt.Errorf("subscription client is closed")
+	}
+	sc.subscriptions[id] = sub
+	sc.mu.Unlock()
+	go sc.deliver(sub)
+
+	if sc.lazy {
+		sc.startRun()
+	}
+
+	// if the client is running, start subscription immediately. Otherwise it's started after connecting
+	sc.postCommand(command{kind: cmdSubscribe, sub: sub})
+
+	// stop the subscription when the context is canceled
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				if sc.removeSubscription(id, ctx.Err()) {
+					sc.sendCommand(command{kind: cmdUnsubscribe, sub: sub})
+				}
+			case <-sub.done:
+			}
+		}()
+	}
+
+	return &SubscriptionHandle{id: id, sc: sc, sub: sub}, nil
+}
+
+// operationPayload encodes the payload of the start message
+func operationPayload(query string, variables map[string]interface{}) (json.RawMessage, error) {
 	in := struct {
 		Query     string                 `json:"query"`
 		Variables map[string]interface{} `json:"variables,omitempty"`
 	}{
-		Query:     sub.query,
-		Variables: sub.variables,
+		Query:     query,
+		Variables: variables,
 	}
+	return json.Marshal(in)
+}
 
-	payload, err := json.Marshal(in)
+// startSubscription sends start message to server, unless the subscription was already started on c
+func (sc *SubscriptionClient) startSubscription(c *connection, sub *subscription) {
+	if c.started[sub.id] || sub.single && sub.starts > 0 {
+		return
+	}
+	if sub.starts > 0 {
+		sc.updateVariables(sub)
+	}
+	sub.starts++
+
+	msgType := GQL_START
+	if c.protocol == GraphQLTransportWS {
+		msgType = GQL_SUBSCRIBE
+	}
+	sc.write(c, OperationMessage{
+		ID:      sub.id,
+		Type:    msgType,
+		Payload: sub.payload,
+	})
+	c.started[sub.id] = true
+}
+
+// updateVariables replaces the variables of sub with the result of its restart hook, if any
+func (sc *SubscriptionClient) updateVariables(sub *subscription) {
+	sc.mu.Lock()
+	onRestart := sub.onRestart
+	sc.mu.Unlock()
+	if onRestart == nil {
+		return
+	}
+	// the hook derives the variables from the messages handled so far
+	sub.pending.Wait()
+
+	variables := withVariableTypes(onRestart(variableValues(sub.variables)), sub.variables)
+	query, err := sub.construct(variables)
 	if err != nil {
-		return err
+		// keep restarting with the previous variables
+		sc.printLog(fmt.Sprintf("failed to construct subscription %s: %s", sub.id, err), GQL_INTERNAL)
+		return
+	}
+	payload, err := operationPayload(query, variables)
+	if err != nil {
+		// keep restarting with the previous variables
+		sc.printLog(fmt.Sprintf("failed to encode variables of subscription %s: %s", sub.id, err), GQL_INTERNAL)
+		return
 	}
+	sub.variables = variables
+	sub.query = query
+	sub.payload = payload
+}
 
-	// send stop message to the server
-	msg := OperationMessage{
-		ID:      id,
-		Type:    GQL_START,
-		Payload: payload,
+// failOperations ends the single result operations that were sent on the connection that ended with cause,
+// instead of sending them again with possible side effects
+func (sc *SubscriptionClient) failOperations(cause error) {
+	err := ErrConnectionReset
+	if cause != nil && !stderrors.Is(cause, ErrConnectionReset) {
+		err = fmt.Errorf("%w: %s", ErrConnectionReset, cause)
+	}
+	for _, sub := range sc.getSubscriptions() {
+		if sub.single && sub.starts > 0 {
+			sc.removeSubscription(sub.id, err)
+		}
 	}
+}
 
-	sc.printLog(msg, GQL_START)
-	if err := sc.conn.WriteJSON(msg); err != nil {
-		return err
+// startSubscriptions starts all subscriptions that haven't been started on c
+func (sc *SubscriptionClient) startSubscriptions(c *connection) {
+	for _, sub := range sc.getSubscriptions() {
+		sc.startSubscription(c, sub)
 	}
+}
 
-	sub.started = true
-	return nil
+// stopSubscription sends stop message to server if the subscription was started on c
+func (sc *SubscriptionClient) stopSubscription(c *connection, sub *subscription) {
+	if !c.started[sub.id] {
+		return
+	}
+
+	msgType := GQL_STOP
+	if c.protocol == GraphQLTransportWS {
+		msgType = GQL_COMPLETE
+	}
+	sc.write(c, OperationMessage{
+		ID:   sub.id,
+		Type: msgType,
+	})
+	delete(c.started, sub.id)
+}
+
+func (sc *SubscriptionClient) terminate(c *connection) {
+	// graphql-transport-ws has no terminate message, the connection is closed directly
+	if c.protocol == GraphQLTransportWS {
+		return
+	}
+	sc.write(c, OperationMessage{
+		Type: GQL_CONNECTION_TERMINATE,
+	})
+}
+
+// deliver calls the handler of sub with its queued messages, one at a time and in order.
+// Messages received before the subscription ended are still delivered
+func (sc *SubscriptionClient) deliver(sub *subscription) {
+	defer close(sub.drained)
+	for {
+		select {
+		case d := <-sub.queue:
+			sc.callHandler(sub, d)
+		case <-sub.done:
+			for {
+				select {
+				case d := <-sub.queue:
+					sc.callHandler(sub, d)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (sc *SubscriptionClient) callHandler(sub *subscription, d delivery) {
+	defer sub.pending.Done()
+	if sc.workers != nil {
+		sc.workers <- struct{}{}
+		defer func() { <-sc.workers }()
+	}
+	if err := sub.handler(d.data, d.err); err != nil {
+		// the Run goroutine may be waiting for this handler to make room in the queue
+		go func() {
+			if !sc.sendCommand(command{kind: cmdError, err: err}) {
+				sc.printLog(err, GQL_INTERNAL)
+			}
+		}()
+	}
 }
 
-func (sc *SubscriptionClient) wrapHandler(fn handlerFunc) func(data *json.RawMessage, err error) {
-	return func(data *json.RawMessage, err error) {
-		if errValue := fn(data, err); errValue != nil {
-			sc.errorChan <- errValue
+// dispatch queues d for the handler of sub according to the overflow policy.
+// It returns the result of the OnError event if the message was rejected
+func (sc *SubscriptionClient) dispatch(sub *subscription, d delivery) error {
+	// counted before it's queued, the handler may take it right away
+	sub.pending.Add(1)
+	select {
+	case sub.queue <- d:
+		return nil
+	default:
+	}
+
+	switch sc.overflowPolicy {
+	case OverflowDropOldest:
+		// the handler may take messages in the meantime, but only this goroutine adds them
+		select {
+		case <-sub.queue:
+			sub.pending.Done()
+		default:
 		}
+		select {
+		case sub.queue <- d:
+		default:
+			sub.pending.Done()
+		}
+	case OverflowDropNewest:
+		sub.pending.Done()
+	case OverflowError:
+		sub.pending.Done()
+		return sc.handleError(fmt.Errorf("%w: %s", ErrQueueFull, sub.id))
+	default:
+		select {
+		case sub.queue <- d:
+		case <-sub.done:
+			sub.pending.Done()
+		}
+	}
+	return nil
+}
+
+// handleError triggers the onError event. A non-nil result stops the client
+func (sc *SubscriptionClient) handleError(err error) error {
+	if sc.onError == nil {
+		return nil
 	}
+	return sc.onError(sc, err)
 }
 
 // Run start websocket client and subscriptions. If this function is run with goroutine, it can be stopped after closed
+// When the connection is lost, the client reconnects and restarts the subscriptions.
+// Connections that fail or are closed before the server acknowledges them are retried according to the backoff strategy.
+// In lazy connection mode, Run waits until the client started by the first subscription is closed
 func (sc *SubscriptionClient) Run() error {
-	if err := sc.init(); err != nil {
-		return fmt.Errorf("retry timeout. exiting...")
+	sc.mu.Lock()
+	if sc.lazy && sc.running {
+		runDone := sc.runDone
+		sc.mu.Unlock()
+		<-runDone
+		return nil
+	}
+	sc.mu.Unlock()
+
+	runDone, err := sc.beginRun()
+	if err != nil || runDone == nil {
+		return err
+	}
+	return sc.runLoop(runDone)
+}
+
+// startRun runs the client in a new goroutine unless it's already running or closed
+func (sc *SubscriptionClient) startRun() {
+	runDone, err := sc.beginRun()
+	if err != nil || runDone == nil {
+		return
+	}
+	go func() {
+		if err := sc.runLoop(runDone); err != nil {
+			sc.printLog(err, GQL_INTERNAL)
+		}
+	}()
+}
+
+// beginRun marks the client as running. It returns a nil channel if the client is closed
+func (sc *SubscriptionClient) beginRun() (chan struct{}, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return nil, nil
+	}
+	if sc.running {
+		return nil, fmt.Errorf("subscription client is already running")
 	}
+	sc.running = true
+	sc.runDone = make(chan struct{})
+	return sc.runDone, nil
+}
+
+func (sc *SubscriptionClient) runLoop(runDone chan struct{}) (err error) {
+	defer func() {
+		sc.setState(StateIdle, err, 0)
+		sc.mu.Lock()
+		sc.running = false
+		close(runDone)
+		sc.mu.Unlock()
+	}()
+
+	backoff := sc.getBackoff()
+	attempt := 0
+	var failingSince time.Time
+	var lastErr error
+
+	for {
+		if sc.lazy && sc.subscriptionCount() == 0 {
+			// nothing to connect for
+			attempt = 0
+			if stop, err := sc.idle(); stop {
+				return err
+			}
+		}
+
+		if attempt > 0 {
+			delay, ok := backoff.NextDelay(attempt, time.Since(failingSince))
+			if !ok {
+				if sc.onDisconnected != nil {
+					sc.onDisconnected()
+				}
+				return fmt.Errorf("retry timeout. exiting...: %w", lastErr)
+			}
+			sc.printLog(fmt.Sprintf("retry in %s....", delay), GQL_INTERNAL)
+
+			if stop, err := sc.wait(delay); stop {
+				return err
+			}
+		}
+
+		if sc.State() == StateIdle {
+			sc.setState(StateConnecting, nil, attempt+1)
+		}
+		acked := false
+		c, err := sc.connect()
+		if err == nil {
+			c.attempt = attempt + 1
+			var reconnect bool
+			reconnect, err = sc.run(c)
+			sc.failOperations(err)
+			if !reconnect {
+				return err
+			}
+			if err == nil {
+				// the idle connection was closed in lazy mode
+				sc.setState(StateIdle, nil, 0)
+				attempt = 0
+				continue
+			}
+			acked = c.acked
+		} else if sc.isClosed() {
+			// the client was closed while connecting
+			return nil
+		}
 
-	// lazily start subscriptions
-	for k, v := range sc.subscriptions {
-		if err := sc.startSubscription(k, v); err != nil {
-			sc.Unsubscribe(k)
+		if !sc.shouldRetry(err) {
+			if sc.onDisconnected != nil {
+				sc.onDisconnected()
+			}
 			return err
 		}
+		sc.printLog(fmt.Sprintf("%s. Retry connecting...", err), GQL_INTERNAL)
+		lastErr = err
+
+		if acked {
+			// the connection was healthy, so reconnect immediately and start the backoff over
+			attempt = 0
+		} else {
+			if attempt == 0 {
+				failingSince = time.Now()
+			}
+			attempt++
+		}
+		sc.setState(StateReconnecting, err, attempt+1)
 	}
-	sc.setIsRunning(true)
+}
 
-	for sc.isRunning {
+// wait sleeps for delay between connection attempts while handling commands
+// It reports whether the client must stop, along with the error Run returns
+func (sc *SubscriptionClient) wait(delay time.Duration) (bool, error) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
 		select {
-		case <-sc.context.Done():
-			return nil
-		case e := <-sc.errorChan:
-			if sc.onError != nil {
-				if err := sc.onError(sc, e); err != nil {
-					return err
+		case <-timer.C:
+			return false, nil
+		case cmd := <-sc.commands:
+			switch cmd.kind {
+			case cmdReset:
+				// reconnect immediately
+				return false, nil
+			case cmdClose:
+				cmd.result <- nil
+				return true, nil
+			case cmdError:
+				if err := sc.handleError(cmd.err); err != nil {
+					return true, err
 				}
 			}
-		default:
+			// subscriptions are started after connecting, so there is nothing to do for the other commands
+		}
+	}
+}
+
+// idle waits until a subscription is started in lazy mode
+// It reports whether the client must stop, along with the error Run returns
+func (sc *SubscriptionClient) idle() (bool, error) {
+	for {
+		cmd := <-sc.commands
+		switch cmd.kind {
+		case cmdSubscribe:
+			if _, ok := sc.getSubscription(cmd.sub.id); ok {
+				return false, nil
+			}
+		case cmdClose:
+			cmd.result <- nil
+			return true, nil
+		case cmdError:
+			if err := sc.handleError(cmd.err); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// run handles messages and commands for connection c until it fails or the client is closed
+// It reports whether the client should reconnect, along with the error that stopped the connection.
+// In lazy mode, the connection is closed without error once it has been idle for the idle timeout
+func (sc *SubscriptionClient) run(c *connection) (bool, error) {
+	var ping <-chan time.Time
+	if sc.pingInterval > 0 && c.protocol == GraphQLTransportWS {
+		ticker := time.NewTicker(sc.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
 
-			var message OperationMessage
-			if err := sc.conn.ReadJSON(&message); err != nil {
-				// manual EOF check
-				if err == io.EOF || strings.Contains(err.Error(), "EOF") {
-					return sc.Reset()
+	// the keep alive timer starts with the first message with graphql-transport-ws,
+	// subscriptions-transport-ws only considers keep alive after the first keep alive message
+	var keepAlive *time.Timer
+	var keepAliveTimeout <-chan time.Time
+	keepAliveStarted := c.protocol == GraphQLTransportWS
+	defer func() {
+		if keepAlive != nil {
+			keepAlive.Stop()
+		}
+	}()
+
+	var idle *time.Timer
+	var idleTimeout <-chan time.Time
+	defer func() {
+		if idle != nil {
+			idle.Stop()
+		}
+	}()
+
+	for {
+		if sc.lazy {
+			if sc.subscriptionCount() > 0 {
+				if idle != nil {
+					idle.Stop()
+					idle, idleTimeout = nil, nil
 				}
-				closeStatus := websocket.CloseStatus(err)
-				if closeStatus == websocket.StatusNormalClosure {
-					// close event from websocket client, exiting...
-					return nil
+			} else if idle == nil {
+				idle = time.NewTimer(sc.idleTimeout)
+				idleTimeout = idle.C
+			}
+		}
+
+		select {
+		case <-idleTimeout:
+			idle, idleTimeout = nil, nil
+			if sc.subscriptionCount() == 0 {
+				sc.printLog("no active subscription. Closing idle connection...", GQL_INTERNAL)
+				_ = sc.closeConnection(c, nil)
+				return true, nil
+			}
+		case cmd := <-sc.commands:
+			switch cmd.kind {
+			case cmdSubscribe:
+				// the subscription may have been removed in the meantime
+				if _, ok := sc.getSubscription(cmd.sub.id); ok && c.acked {
+					sc.startSubscription(c, cmd.sub)
 				}
-				if closeStatus != -1 {
-					sc.printLog(fmt.Sprintf("%s. Retry connecting...", err), GQL_INTERNAL)
-					return sc.Reset()
+			case cmdUnsubscribe:
+				sc.stopSubscription(c, cmd.sub)
+			case cmdError:
+				if err := sc.handleError(cmd.err); err != nil {
+					_ = sc.closeConnection(c, sc.getSubscriptions())
+					return false, err
+				}
+			case cmdReset:
+				_ = sc.closeConnection(c, sc.getSubscriptions())
+				return true, ErrConnectionReset
+			case cmdClose:
+				cmd.result <- sc.closeConnection(c, cmd.subs)
+				return false, nil
+			}
+		case err := <-c.writeErr:
+			sc.abortConnection(c)
+			return true, err
+		case <-ping:
+			sc.write(c, OperationMessage{Type: GQL_PING})
+		case <-keepAliveTimeout:
+			sc.printLog(fmt.Sprintf("no message received in %s. Closing connection...", sc.keepAliveTimeout), GQL_INTERNAL)
+			if sc.onKeepAliveTimeout != nil {
+				sc.onKeepAliveTimeout()
+			}
+			sc.abortConnection(c)
+			return true, ErrKeepAliveTimeout
+		case result := <-c.reads:
+			if err := result.err; err != nil {
+				if isDecodeError(err) {
+					if err = sc.handleError(err); err != nil {
+						_ = sc.closeConnection(c, sc.getSubscriptions())
+						return false, err
+					}
+					continue
 				}
 
-				if sc.onError != nil {
-					if err = sc.onError(sc, err); err != nil {
-						return err
+				sc.abortConnection(c)
+				if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+					// the server closed the connection, exiting...
+					return false, nil
+				}
+				return true, err
+			}
+
+			message := result.message
+			if message.Type == GQL_CONNECTION_KEEP_ALIVE {
+				keepAliveStarted = true
+			}
+			if keepAliveStarted && sc.keepAliveTimeout > 0 {
+				if keepAlive == nil {
+					keepAlive = time.NewTimer(sc.keepAliveTimeout)
+					keepAliveTimeout = keepAlive.C
+				} else {
+					if !keepAlive.Stop() {
+						select {
+						case <-keepAlive.C:
+						default:
+						}
 					}
+					keepAlive.Reset(sc.keepAliveTimeout)
 				}
-				continue
 			}
 
 			switch message.Type {
 			case GQL_ERROR:
 				sc.printLog(message, GQL_ERROR)
-				fallthrough
-			case GQL_DATA:
-				sc.printLog(message, GQL_DATA)
-				id, err := uuid.Parse(message.ID)
-				if err != nil {
+				sub, ok := sc.getSubscription(message.ID)
+				if !ok {
 					continue
 				}
-				sub, ok := sc.subscriptions[id.String()]
+				if err := sc.dispatch(sub, delivery{err: parseErrorPayload(message.Payload)}); err != nil {
+					_ = sc.closeConnection(c, sc.getSubscriptions())
+					return false, err
+				}
+				// the operation is terminated by the error, there is no complete message
+				sc.removeSubscription(message.ID, nil)
+				delete(c.started, message.ID)
+			case GQL_DATA, GQL_NEXT:
+				sc.printLog(message, message.Type)
+				sub, ok := sc.getSubscription(message.ID)
 				if !ok {
 					continue
 				}
@@ -422,26 +1698,42 @@ func (sc *SubscriptionClient) Run() error {
 					//Extensions interface{} // Unused.
 				}
 
-				err = json.Unmarshal(message.Payload, &out)
-				if err != nil {
-					go sub.handler(nil, err)
-					continue
+				var d delivery
+				if err := json.Unmarshal(message.Payload, &out); err != nil {
+					d.err = err
+				} else {
+					// partial data is delivered along with errors
+					d.data = out.Data
+					if len(out.Errors) > 0 {
+						d.err = out.Errors
+					}
 				}
-				if len(out.Errors) > 0 {
-					go sub.handler(nil, out.Errors)
-					continue
+				if err := sc.dispatch(sub, d); err != nil {
+					_ = sc.closeConnection(c, sc.getSubscriptions())
+					return false, err
 				}
-
-				go sub.handler(out.Data, nil)
 			case GQL_CONNECTION_ERROR:
 				sc.printLog(message, GQL_CONNECTION_ERROR)
+				_ = sc.closeConnection(c, nil)
+				return true, &ConnectionError{Payload: message.Payload}
 			case GQL_COMPLETE:
 				sc.printLog(message, GQL_COMPLETE)
-				sc.Unsubscribe(message.ID)
+				// the server has completed the operation, so there is no need to send stop message
+				sc.removeSubscription(message.ID, nil)
+				delete(c.started, message.ID)
 			case GQL_CONNECTION_KEEP_ALIVE:
 				sc.printLog(message, GQL_CONNECTION_KEEP_ALIVE)
+			case GQL_PING:
+				sc.printLog(message, GQL_PING)
+				sc.write(c, OperationMessage{Type: GQL_PONG})
+			case GQL_PONG:
+				sc.printLog(message, GQL_PONG)
 			case GQL_CONNECTION_ACK:
 				sc.printLog(message, GQL_CONNECTION_ACK)
+				// subscriptions can only be started after the server acknowledged the connection
+				c.acked = true
+				sc.setState(StateConnected, nil, c.attempt)
+				sc.startSubscriptions(c)
 				if sc.onConnected != nil {
 					sc.onConnected()
 				}
@@ -450,101 +1742,139 @@ func (sc *SubscriptionClient) Run() error {
 			}
 		}
 	}
+}
 
-	// if the running status is false, stop retrying
-	if !sc.isRunning {
-		return nil
-	}
+func (sc *SubscriptionClient) getSubscription(id string) (*subscription, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sub, ok := sc.subscriptions[id]
+	return sub, ok
+}
 
-	return sc.Reset()
+func (sc *SubscriptionClient) subscriptionCount() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.subscriptions)
 }
 
-// Unsubscribe sends stop message to server and close subscription channel
-// The input parameter is subscription ID that is returned from Subscribe function
-func (sc *SubscriptionClient) Unsubscribe(id string) error {
-	_, ok := sc.subscriptions[id]
-	if !ok {
-		return fmt.Errorf("subscription id %s doesn't not exist", id)
+func (sc *SubscriptionClient) getSubscriptions() []*subscription {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	subs := make([]*subscription, 0, len(sc.subscriptions))
+	for _, sub := range sc.subscriptions {
+		subs = append(subs, sub)
 	}
+	return subs
+}
 
-	err := sc.stopSubscription(id)
+// parseErrorPayload decodes the payload of an error message.
+// graphql-transport-ws sends an array of errors, subscriptions-transport-ws sends a single error object
+func parseErrorPayload(payload json.RawMessage) error {
+	var errs errors
+	if err := json.Unmarshal(payload, &errs); err == nil && len(errs) > 0 {
+		return errs
+	}
+	errs = make(errors, 1)
+	if err := json.Unmarshal(payload, &errs[0]); err != nil {
+		return err
+	}
+	if errs[0].Message == "" {
+		errs[0].Message = string(payload)
+	}
+	return errs
+}
 
-	sc.subscribersMu.Lock()
-	delete(sc.subscriptions, id)
-	sc.subscribersMu.Unlock()
-	return err
+// isAuthError reports whether the server rejected the connection, usually because of invalid credentials
+func isAuthError(err error) bool {
+	if _, ok := err.(*ConnectionError); ok {
+		return true
+	}
+	switch websocket.CloseStatus(err) {
+	case StatusUnauthorized, StatusForbidden:
+		return true
+	}
+	return false
 }
 
-func (sc *SubscriptionClient) stopSubscription(id string) error {
-	if sc.conn != nil {
-		// send stop message to the server
-		msg := OperationMessage{
-			ID:   id,
-			Type: GQL_STOP,
-		}
+// isFatalCloseStatus reports whether the close status sent by a graphql-transport-ws server
+// indicates an error that reconnecting won't fix
+func isFatalCloseStatus(status websocket.StatusCode) bool {
+	switch status {
+	case StatusInternalServerError, StatusBadRequest, StatusUnauthorized, StatusForbidden,
+		StatusSubprotocolNotAcceptable, StatusSubscriberAlreadyExists, StatusTooManyInitialisationRequests:
+		return true
+	}
+	return false
+}
 
-		sc.printLog(msg, GQL_STOP)
-		if err := sc.conn.WriteJSON(msg); err != nil {
-			return err
-		}
+// isDecodeError reports whether err was caused by a message that isn't valid JSON or doesn't match OperationMessage
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return stderrors.As(err, &syntaxErr) || stderrors.As(err, &typeErr)
+}
 
+// Unsubscribe sends stop message to server and close subscription channel
+// The input parameter is subscription ID that is returned from Subscribe function
+func (sc *SubscriptionClient) Unsubscribe(id string) error {
+	sub, ok := sc.getSubscription(id)
+	if !ok || !sc.removeSubscription(id, nil) {
+		return fmt.Errorf("subscription id %s doesn't not exist", id)
 	}
 
+	sc.postCommand(command{kind: cmdUnsubscribe, sub: sub})
 	return nil
 }
 
-func (sc *SubscriptionClient) terminate() error {
-	if sc.conn != nil {
-		// send terminate message to the server
-		msg := OperationMessage{
-			Type: GQL_CONNECTION_TERMINATE,
-		}
-
-		sc.printLog(msg, GQL_CONNECTION_TERMINATE)
-		return sc.conn.WriteJSON(msg)
+// removeSubscription deletes the subscription and marks it as done with err
+// It returns false if the subscription doesn't exist
+func (sc *SubscriptionClient) removeSubscription(id string, err error) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sub, ok := sc.subscriptions[id]
+	if !ok {
+		return false
 	}
-
-	return nil
+	delete(sc.subscriptions, id)
+	sub.err = err
+	close(sub.done)
+	return true
 }
 
 // Reset restart websocket connection and subscriptions
+// The connection is closed and Run reconnects in its own goroutine
 func (sc *SubscriptionClient) Reset() error {
-	if !sc.isRunning {
-		return nil
-	}
-
-	for id, sub := range sc.subscriptions {
-		_ = sc.stopSubscription(id)
-		sub.started = false
-	}
-
-	if sc.conn != nil {
-		_ = sc.terminate()
-		_ = sc.conn.Close()
-		sc.conn = nil
-	}
-	sc.cancel()
-
-	return sc.Run()
+	sc.postCommand(command{kind: cmdReset})
+	return nil
 }
 
 // Close closes all subscription channel and websocket as well
+// The client can't be used anymore after closing
 func (sc *SubscriptionClient) Close() (err error) {
-	sc.setIsRunning(false)
-	for id := range sc.subscriptions {
-		if err = sc.Unsubscribe(id); err != nil {
-			sc.cancel()
-			return err
-		}
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return nil
 	}
-	if sc.conn != nil {
-		_ = sc.terminate()
-		err = sc.conn.Close()
-		sc.conn = nil
+	sc.closed = true
+	subs := make([]*subscription, 0, len(sc.subscriptions))
+	for id, sub := range sc.subscriptions {
+		subs = append(subs, sub)
+		delete(sc.subscriptions, id)
+		close(sub.done)
 	}
-	sc.cancel()
+	// abort connecting, the Run goroutine can't receive commands in the meantime
+	if sc.connecting {
+		sc.cancel()
+	}
+	sc.mu.Unlock()
+	sc.setState(StateClosed, nil, 0)
 
-	return
+	result := make(chan error, 1)
+	if sc.sendCommand(command{kind: cmdClose, subs: subs, result: result}) {
+		return <-result
+	}
+	return nil
 }
 
 // default websocket handler implementation using https://github.com/nhooyr/websocket
@@ -571,10 +1901,12 @@ func (wh *websocketHandler) Close() error {
 	return wh.Conn.Close(websocket.StatusNormalClosure, "close websocket")
 }
 
-func newWebsocketConn(sc *SubscriptionClient) (WebsocketConn, error) {
+// NewWebsocketConn opens the default websocket connection of the subscription client.
+// It can be used by a custom WithWebSocket function that wraps the connection
+func NewWebsocketConn(sc *SubscriptionClient) (WebsocketConn, error) {
 
 	options := &websocket.DialOptions{
-		Subprotocols: []string{"graphql-ws"},
+		Subprotocols: sc.GetSubprotocols(),
 	}
 	c, _, err := websocket.Dial(sc.GetContext(), sc.GetURL(), options)
 	if err != nil {
@@ -0,0 +1,1243 @@
+package graphql_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/machship-mm/go-graphql-client"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// subscriptionServer is a minimal websocket server speaking both subscription protocols.
+// Every started operation receives the messages in events, followed by a complete message unless keepOpen is set.
+// Connections whose index is in closeStatus are closed with the status code after connection_init instead.
+// Events are sent eventDelay apart. Payloads of started operations are sent to started if it's set. If keepAlive is set, a single keep alive message follows connection_ack, and the server stays silent afterwards.
+// If authorize is set and returns false, connection_init is rejected with a connection error message or an unauthorized close code.
+type subscriptionServer struct {
+	*httptest.Server
+	protocols      []string
+	authorize      func(payload json.RawMessage) bool
+	events         []string
+	started        chan json.RawMessage
+	eventDelay     time.Duration
+	keepOpen       bool
+	keepAlive      bool
+	closeStatus    map[int32]websocket.StatusCode
+	connections    int32
+	disconnections int32
+	stops          int32
+	pings          int32
+}
+
+func newSubscriptionServer(t *testing.T, protocols []string, events ...string) *subscriptionServer {
+	s := &subscriptionServer{protocols: protocols, events: events}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: s.protocols})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+		s.serve(r.Context(), c, atomic.AddInt32(&s.connections, 1)-1)
+		atomic.AddInt32(&s.disconnections, 1)
+	}))
+	return s
+}
+
+func (s *subscriptionServer) serve(ctx context.Context, c *websocket.Conn, index int32) {
+	dataType := graphql.GQL_DATA
+	if c.Subprotocol() == string(graphql.GraphQLTransportWS) {
+		dataType = graphql.GQL_NEXT
+	}
+	for {
+		var msg graphql.OperationMessage
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case graphql.GQL_CONNECTION_INIT:
+			if status, ok := s.closeStatus[index]; ok {
+				_ = c.Close(status, "closed by test server")
+				return
+			}
+			if s.authorize != nil && !s.authorize(msg.Payload) {
+				if c.Subprotocol() == string(graphql.GraphQLTransportWS) {
+					_ = c.Close(graphql.StatusUnauthorized, "unauthorized")
+					return
+				}
+				_ = wsjson.Write(ctx, c, graphql.OperationMessage{Type: graphql.GQL_CONNECTION_ERROR, Payload: json.RawMessage(`{"message":"unauthorized"}`)})
+				continue
+			}
+			_ = wsjson.Write(ctx, c, graphql.OperationMessage{Type: graphql.GQL_CONNECTION_ACK})
+			if s.keepAlive {
+				_ = wsjson.Write(ctx, c, graphql.OperationMessage{Type: graphql.GQL_CONNECTION_KEEP_ALIVE})
+			}
+		case graphql.GQL_PING:
+			atomic.AddInt32(&s.pings, 1)
+			_ = wsjson.Write(ctx, c, graphql.OperationMessage{Type: graphql.GQL_PONG})
+		case graphql.GQL_START, graphql.GQL_SUBSCRIBE:
+			if s.started != nil {
+				s.started <- msg.Payload
+			}
+			for i, e := range s.events {
+				if i > 0 {
+					time.Sleep(s.eventDelay)
+				}
+				_ = wsjson.Write(ctx, c, graphql.OperationMessage{ID: msg.ID, Type: dataType, Payload: json.RawMessage(e)})
+			}
+			if !s.keepOpen {
+				_ = wsjson.Write(ctx, c, graphql.OperationMessage{ID: msg.ID, Type: graphql.GQL_COMPLETE})
+			}
+		case graphql.GQL_STOP, graphql.GQL_COMPLETE:
+			atomic.AddInt32(&s.stops, 1)
+		}
+	}
+}
+
+func (s *subscriptionServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func TestSubscriptionClient_protocols(t *testing.T) {
+	tests := []struct {
+		serverProtocols []string
+		clientProtocol  graphql.SubscriptionProtocolType
+		want            graphql.SubscriptionProtocolType
+	}{
+		{
+			serverProtocols: []string{"graphql-ws"},
+			want:            graphql.SubscriptionsTransportWS,
+		},
+		{
+			serverProtocols: []string{"graphql-transport-ws"},
+			want:            graphql.GraphQLTransportWS,
+		},
+		{
+			serverProtocols: []string{"graphql-transport-ws", "graphql-ws"},
+			clientProtocol:  graphql.SubscriptionsTransportWS,
+			want:            graphql.SubscriptionsTransportWS,
+		},
+		{
+			serverProtocols: []string{"graphql-ws", "graphql-transport-ws"},
+			clientProtocol:  graphql.GraphQLTransportWS,
+			want:            graphql.GraphQLTransportWS,
+		},
+	}
+	for i, tc := range tests {
+		server := newSubscriptionServer(t, tc.serverProtocols, `{"data":{"hello":"world"}}`)
+
+		client := graphql.NewSubscriptionClient(server.wsURL()).WithProtocol(tc.clientProtocol)
+		received := make(chan string, 1)
+		var sub struct {
+			Hello graphql.GqlString
+		}
+		_, err := client.Subscribe(sub, nil, func(data *json.RawMessage, err error) error {
+			if err != nil {
+				t.Error(err)
+				return nil
+			}
+			received <- string(*data)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Run()
+
+		select {
+		case got := <-received:
+			if want := `{"hello":"world"}`; got != want {
+				t.Errorf("test case %d: got data: %s, want: %s", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("test case %d: timed out waiting for data", i)
+		}
+		if got := client.GetProtocol(); got != tc.want {
+			t.Errorf("test case %d: got protocol: %q, want: %q", i, got, tc.want)
+		}
+
+		_ = client.Close()
+		server.Close()
+	}
+}
+
+func TestSubscriptionClient_SubscribeInto(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"hello":"world"}}`, `{"data":{"hello":1}}`)
+	defer server.Close()
+
+	type subscription struct {
+		Hello graphql.GqlString
+	}
+	client := graphql.NewSubscriptionClient(server.wsURL())
+	defer client.Close()
+
+	received := make(chan *subscription, 1)
+	failed := make(chan error, 1)
+	_, err := client.SubscribeInto(subscription{}, nil, func(data interface{}, err error) error {
+		if err != nil {
+			failed <- err
+			return nil
+		}
+		received <- data.(*subscription)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	var values, errs int
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-received:
+			values++
+			if got.Hello.String != "world" {
+				t.Errorf("got hello: %q, want: %q", got.Hello.String, "world")
+			}
+		case <-failed:
+			// the second payload can't be decoded into a string
+			errs++
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for data")
+		}
+	}
+	if values != 1 || errs != 1 {
+		t.Errorf("got %d values and %d errors, want: 1 and 1", values, errs)
+	}
+}
+
+func TestSubscriptionClient_SubscribeChan(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-ws"}, `{"data":{"hello":"world"}}`)
+	defer server.Close()
+
+	type subscription struct {
+		Hello graphql.GqlString
+	}
+	client := graphql.NewSubscriptionClient(server.wsURL())
+	defer client.Close()
+
+	if _, err := client.SubscribeChan(subscription{}, nil, make(chan string)); err == nil {
+		t.Error("got error: nil, want: non-nil")
+	}
+
+	ch := make(chan subscription, 1)
+	if _, err := client.SubscribeChan(subscription{}, nil, ch); err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	select {
+	case got := <-ch:
+		if got.Hello.String != "world" {
+			t.Errorf("got hello: %q, want: %q", got.Hello.String, "world")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for data")
+	}
+}
+
+func TestSubscriptionClient_reconnect(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"hello":"world"}}`)
+	server.closeStatus = map[int32]websocket.StatusCode{0: websocket.StatusServiceRestart, 1: websocket.StatusTryAgainLater}
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithBackoff(graphql.ConstantBackoff{Interval: time.Millisecond})
+	defer client.Close()
+
+	received := make(chan struct{}, 1)
+	var sub struct {
+		Hello graphql.GqlString
+	}
+	_, err := client.Subscribe(sub, nil, func(data *json.RawMessage, err error) error {
+		received <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for data")
+	}
+	if got, want := atomic.LoadInt32(&server.connections), int32(3); got != want {
+		t.Errorf("got %d connections, want: %d", got, want)
+	}
+}
+
+func TestSubscriptionClient_retryCondition(t *testing.T) {
+	tests := []struct {
+		status    websocket.StatusCode
+		condition func(sc *graphql.SubscriptionClient, err error) bool
+	}{
+		{
+			// stops on fatal close codes by default
+			status: graphql.StatusUnauthorized,
+		},
+		{
+			status: websocket.StatusServiceRestart,
+			condition: func(sc *graphql.SubscriptionClient, err error) bool {
+				return websocket.CloseStatus(err) != websocket.StatusServiceRestart
+			},
+		},
+	}
+	for i, tc := range tests {
+		server := newSubscriptionServer(t, []string{"graphql-transport-ws"})
+		server.closeStatus = map[int32]websocket.StatusCode{0: tc.status}
+
+		client := graphql.NewSubscriptionClient(server.wsURL()).WithRetryCondition(tc.condition)
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Run()
+		}()
+
+		select {
+		case err := <-done:
+			if got := websocket.CloseStatus(err); got != tc.status {
+				t.Errorf("test case %d: got close status: %v, want: %v", i, got, tc.status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("test case %d: timed out waiting for Run to return", i)
+		}
+		if got := atomic.LoadInt32(&server.connections); got != 1 {
+			t.Errorf("test case %d: got %d connections, want: 1", i, got)
+		}
+		server.Close()
+	}
+}
+
+func TestSubscriptionClient_SubscribeWithContext(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"hello":"world"}}`)
+	server.keepOpen = true
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL())
+	defer client.Close()
+
+	received := make(chan struct{}, 1)
+	var sub struct {
+		Hello graphql.GqlString
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	handle, err := client.SubscribeWithContext(ctx, sub, nil, func(data *json.RawMessage, err error) error {
+		received <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for data")
+	}
+	if err := handle.Err(); err != nil {
+		t.Errorf("got error: %v, want: nil", err)
+	}
+
+	cancel()
+	select {
+	case <-handle.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the subscription to end")
+	}
+	if got, want := handle.Err(), context.Canceled; got != want {
+		t.Errorf("got error: %v, want: %v", got, want)
+	}
+	if err := handle.Unsubscribe(); err != nil {
+		t.Errorf("got error: %v, want: nil", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&server.stops) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the server to receive the stop message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := client.SubscribeWithContext(ctx, sub, nil, nil); err != context.Canceled {
+		t.Errorf("got error: %v, want: %v", err, context.Canceled)
+	}
+}
+
+func TestSubscriptionClient_keepAliveTimeout(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-ws"})
+	server.keepAlive = true
+	defer server.Close()
+
+	timeouts := make(chan struct{}, 2)
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithKeepAlive(50 * time.Millisecond).
+		OnKeepAliveTimeout(func() {
+			timeouts <- struct{}{}
+		})
+	defer client.Close()
+	go client.Run()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-timeouts:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for keep-alive timeout")
+		}
+	}
+	// the client reconnects after every keep-alive timeout
+	if got := atomic.LoadInt32(&server.connections); got < 2 {
+		t.Errorf("got %d connections, want at least 2", got)
+	}
+}
+
+func TestSubscriptionClient_ping(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"})
+	defer server.Close()
+
+	timeouts := make(chan struct{}, 1)
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithPingInterval(10 * time.Millisecond).
+		WithKeepAlive(time.Second).
+		OnKeepAliveTimeout(func() {
+			timeouts <- struct{}{}
+		})
+	defer client.Close()
+	go client.Run()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&server.pings) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for pings")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-timeouts:
+		t.Error("got keep-alive timeout while the server answers pings")
+	default:
+	}
+}
+
+func TestSubscriptionClient_WithConnectionParamsFn(t *testing.T) {
+	for _, protocol := range []string{"graphql-ws", "graphql-transport-ws"} {
+		server := newSubscriptionServer(t, []string{protocol}, `{"data":{"hello":"world"}}`)
+		server.authorize = func(payload json.RawMessage) bool {
+			return string(payload) == `{"token":"token-3"}`
+		}
+
+		var calls int32
+		client := graphql.NewSubscriptionClient(server.wsURL()).
+			WithBackoff(graphql.ConstantBackoff{Interval: time.Millisecond}).
+			WithConnectionParamsFn(func(ctx context.Context) (map[string]interface{}, error) {
+				n := atomic.AddInt32(&calls, 1)
+				return map[string]interface{}{"token": fmt.Sprintf("token-%d", n)}, nil
+			})
+
+		received := make(chan struct{}, 1)
+		var sub struct {
+			Hello graphql.GqlString
+		}
+		_, err := client.Subscribe(sub, nil, func(data *json.RawMessage, err error) error {
+			received <- struct{}{}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Run()
+
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for data", protocol)
+		}
+		if got := atomic.LoadInt32(&calls); got != 3 {
+			t.Errorf("%s: got %d calls, want: 3", protocol, got)
+		}
+
+		_ = client.Close()
+		server.Close()
+	}
+}
+
+func TestSubscriptionClient_authErrorWithStaticParams(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-ws"})
+	server.authorize = func(payload json.RawMessage) bool {
+		return false
+	}
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithConnectionParams(map[string]interface{}{"token": "expired"})
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if _, ok := err.(*graphql.ConnectionError); !ok {
+			t.Errorf("got error: %v, want: *graphql.ConnectionError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Run to return")
+	}
+}
+
+// TestSubscriptionClient_concurrent stresses the client with concurrent calls. Run with -race
+func TestSubscriptionClient_concurrent(t *testing.T) {
+	for _, protocol := range []string{"graphql-ws", "graphql-transport-ws"} {
+		server := newSubscriptionServer(t, []string{protocol}, `{"data":{"hello":"world"}}`)
+		server.keepOpen = true
+
+		client := graphql.NewSubscriptionClient(server.wsURL()).
+			WithBackoff(graphql.ConstantBackoff{Interval: time.Millisecond})
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Run()
+		}()
+
+		var sub struct {
+			Hello graphql.GqlString
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					id, err := client.Subscribe(sub, nil, func(data *json.RawMessage, err error) error {
+						return nil
+					})
+					if err != nil {
+						// the client was closed
+						return
+					}
+					if j%2 == 0 {
+						_ = client.Unsubscribe(id)
+					}
+					if i%5 == 0 && j == 5 {
+						_ = client.Reset()
+					}
+				}
+			}(i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(20 * time.Millisecond)
+			_ = client.Close()
+		}()
+		wg.Wait()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s: got error: %v, want: nil", protocol, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for Run to return", protocol)
+		}
+		if _, err := client.Subscribe(sub, nil, func(data *json.RawMessage, err error) error {
+			return nil
+		}); err == nil {
+			t.Errorf("%s: subscribing after Close succeeded, want error", protocol)
+		}
+		server.Close()
+	}
+}
+
+func TestSubscriptionClient_closeBeforeRun(t *testing.T) {
+	client := graphql.NewSubscriptionClient("ws://localhost:1")
+	var sub struct {
+		Hello graphql.GqlString
+	}
+	handle, err := client.SubscribeWithContext(context.Background(), sub, nil, func(data *json.RawMessage, err error) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handle.Done():
+	default:
+		t.Error("subscription isn't done after Close")
+	}
+	if err := client.Run(); err != nil {
+		t.Errorf("got error: %v, want: nil", err)
+	}
+}
+
+func TestSubscriptionClient_ordered(t *testing.T) {
+	var events []string
+	for i := 0; i < 50; i++ {
+		events = append(events, fmt.Sprintf(`{"data":{"count":%d}}`, i))
+	}
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, events...)
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL()).WithQueueSize(5)
+	defer client.Close()
+
+	var sub struct {
+		Count graphql.GqlInt64
+	}
+	received := make(chan int64, len(events))
+	_, err := client.SubscribeInto(sub, nil, func(data interface{}, err error) error {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		received <- data.(*struct{ Count graphql.GqlInt64 }).Count.Int64
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	for i := range events {
+		select {
+		case count := <-received:
+			if count != int64(i) {
+				t.Fatalf("got message %d at position %d, want messages in order", count, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+}
+
+func TestSubscriptionClient_overflowPolicy(t *testing.T) {
+	tests := []struct {
+		policy     graphql.OverflowPolicy
+		want       string
+		wantErrors int32
+	}{
+		{graphql.OverflowBlock, "1,2,3,4,5", 0},
+		{graphql.OverflowDropOldest, "1,5", 0},
+		{graphql.OverflowDropNewest, "1,2", 0},
+		{graphql.OverflowError, "1,2", 3},
+	}
+	for _, tc := range tests {
+		server := newSubscriptionServer(t, []string{"graphql-transport-ws"},
+			`{"data":{"count":1}}`, `{"data":{"count":2}}`, `{"data":{"count":3}}`, `{"data":{"count":4}}`, `{"data":{"count":5}}`)
+		server.eventDelay = 20 * time.Millisecond
+		server.keepOpen = true
+
+		var errorCount int32
+		client := graphql.NewSubscriptionClient(server.wsURL()).
+			WithQueueSize(1).
+			WithOverflowPolicy(tc.policy).
+			OnError(func(sc *graphql.SubscriptionClient, err error) error {
+				if !errors.Is(err, graphql.ErrQueueFull) {
+					t.Errorf("got error: %v, want: %v", err, graphql.ErrQueueFull)
+				}
+				atomic.AddInt32(&errorCount, 1)
+				return nil
+			})
+
+		release := make(chan struct{})
+		received := make(chan int64, 5)
+		var sub struct {
+			Count graphql.GqlInt64
+		}
+		_, err := client.SubscribeInto(sub, nil, func(data interface{}, err error) error {
+			count := data.(*struct{ Count graphql.GqlInt64 }).Count.Int64
+			if count == 1 {
+				// hold the handler until all events were received
+				<-release
+			}
+			received <- count
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Run()
+
+		time.Sleep(150 * time.Millisecond)
+		close(release)
+
+		var got []string
+		timeout := time.After(300 * time.Millisecond)
+	loop:
+		for {
+			select {
+			case count := <-received:
+				got = append(got, fmt.Sprint(count))
+			case <-timeout:
+				break loop
+			}
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("policy %d: got %s, want: %s", tc.policy, strings.Join(got, ","), tc.want)
+		}
+		if got := atomic.LoadInt32(&errorCount); got != tc.wantErrors {
+			t.Errorf("policy %d: got %d errors, want: %d", tc.policy, got, tc.wantErrors)
+		}
+
+		_ = client.Close()
+		server.Close()
+	}
+}
+
+func TestSubscriptionClient_overflowBlockCommands(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"},
+		`{"data":{"count":1}}`, `{"data":{"count":2}}`, `{"data":{"count":3}}`)
+	server.keepOpen = true
+	defer server.Close()
+
+	// the third message is logged when the Run goroutine is about to wait for room in the full queue
+	third := make(chan struct{})
+	var once sync.Once
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithQueueSize(1).
+		WithLog(func(args ...interface{}) {
+			if strings.Contains(fmt.Sprint(args...), `"count":3`) {
+				once.Do(func() { close(third) })
+			}
+		})
+	defer client.Close()
+
+	var sub struct {
+		Count graphql.GqlInt64
+	}
+	received := make(chan int64, 3)
+	_, err := client.SubscribeInto(sub, nil, func(data interface{}, err error) error {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		count := data.(*struct{ Count graphql.GqlInt64 }).Count.Int64
+		if count == 1 {
+			<-third
+			id, err := client.Subscribe(sub, nil, func(message *json.RawMessage, err error) error { return nil })
+			if err != nil {
+				t.Error(err)
+			} else if err := client.Unsubscribe(id); err != nil {
+				t.Error(err)
+			}
+		}
+		received <- count
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	for i := int64(1); i <= 3; i++ {
+		select {
+		case count := <-received:
+			if count != i {
+				t.Fatalf("got message %d, want: %d", count, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+}
+
+func TestSubscriptionClient_WithMaxConcurrentHandlers(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-ws"}, `{"data":{"hello":"world"}}`)
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL()).WithMaxConcurrentHandlers(2)
+	defer client.Close()
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	var sub struct {
+		Hello graphql.GqlString
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		_, err := client.Subscribe(sub, nil, func(data *json.RawMessage, err error) error {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	go client.Run()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for handlers")
+	}
+	if got := atomic.LoadInt32(&maxRunning); got != 2 {
+		t.Errorf("got %d concurrent handlers, want: 2", got)
+	}
+}
+
+func TestSubscriptionClient_WithLazyConnect(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"hello":"world"}}`)
+	server.keepOpen = true
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL()).WithLazyConnect(50 * time.Millisecond)
+	defer client.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&server.connections); got != 0 {
+		t.Fatalf("got %d connections before subscribing, want: 0", got)
+	}
+
+	var sub struct {
+		Hello graphql.GqlString
+	}
+	for i := 1; i <= 2; i++ {
+		received := make(chan struct{}, 1)
+		id, err := client.Subscribe(sub, nil, func(data *json.RawMessage, err error) error {
+			received <- struct{}{}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for data")
+		}
+		if got := atomic.LoadInt32(&server.connections); got != int32(i) {
+			t.Fatalf("got %d connections, want: %d", got, i)
+		}
+
+		if err := client.Unsubscribe(id); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&server.disconnections) != int32(i) {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the idle connection to be closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestSubscriptionClient_OnStateChange(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"hello":"world"}}`)
+	server.closeStatus = map[int32]websocket.StatusCode{0: websocket.StatusTryAgainLater}
+	server.keepOpen = true
+	defer server.Close()
+
+	changes := make(chan graphql.StateChange, 10)
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithBackoff(graphql.ConstantBackoff{Interval: time.Millisecond}).
+		OnStateChange(func(change graphql.StateChange) {
+			changes <- change
+		})
+	if got := client.State(); got != graphql.StateIdle {
+		t.Errorf("got state %s before Run, want: %s", got, graphql.StateIdle)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run()
+	}()
+
+	want := []struct {
+		from, to graphql.ConnectionState
+		attempt  int
+	}{
+		{graphql.StateIdle, graphql.StateConnecting, 1},
+		{graphql.StateConnecting, graphql.StateReconnecting, 2},
+		{graphql.StateReconnecting, graphql.StateConnected, 2},
+	}
+	for _, w := range want {
+		select {
+		case change := <-changes:
+			if change.From != w.from || change.To != w.to || change.Attempt != w.attempt {
+				t.Fatalf("got change %s -> %s attempt %d, want: %s -> %s attempt %d", change.From, change.To, change.Attempt, w.from, w.to, w.attempt)
+			}
+			if change.To == graphql.StateReconnecting && websocket.CloseStatus(change.Cause) != websocket.StatusTryAgainLater {
+				t.Errorf("got cause %v, want close status %d", change.Cause, websocket.StatusTryAgainLater)
+			}
+			if change.Time.IsZero() {
+				t.Error("got zero time")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for change to %s", w.to)
+		}
+	}
+	if got := client.State(); got != graphql.StateConnected {
+		t.Errorf("got state %s, want: %s", got, graphql.StateConnected)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if change := <-changes; change.To != graphql.StateClosed {
+		t.Errorf("got change to %s, want: %s", change.To, graphql.StateClosed)
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("got change to %s after closing", change.To)
+	default:
+	}
+}
+
+func TestSubscriptionClient_Query(t *testing.T) {
+	for _, protocol := range []string{"graphql-ws", "graphql-transport-ws"} {
+		server := newSubscriptionServer(t, []string{protocol}, `{"data":{"viewer":{"login":"gopher"}}}`)
+		server.started = make(chan json.RawMessage, 2)
+
+		client := graphql.NewSubscriptionClient(server.wsURL())
+		go client.Run()
+
+		var q struct {
+			Viewer struct {
+				Login graphql.GqlString
+			}
+		}
+		if err := client.Query(context.Background(), &q, nil); err != nil {
+			t.Fatalf("%s: %v", protocol, err)
+		}
+		if got, want := q.Viewer.Login.String, "gopher"; got != want {
+			t.Errorf("%s: got login %q, want: %q", protocol, got, want)
+		}
+
+		var m struct {
+			Viewer struct {
+				Login graphql.GqlString
+			}
+		}
+		if err := client.NamedMutate(context.Background(), "UpdateViewer", &m, nil); err != nil {
+			t.Fatalf("%s: %v", protocol, err)
+		}
+		if got, want := m.Viewer.Login.String, "gopher"; got != want {
+			t.Errorf("%s: got login %q, want: %q", protocol, got, want)
+		}
+
+		for _, want := range []string{`{"query":"{viewer{login}}"}`, `{"query":"mutation UpdateViewer{viewer{login}}"}`} {
+			if got := string(<-server.started); got != want {
+				t.Errorf("%s: got payload %s, want: %s", protocol, got, want)
+			}
+		}
+
+		_ = client.Close()
+		server.Close()
+	}
+}
+
+func TestSubscriptionClient_Mutate_reconnect(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"addUser":{"id":"1"}}}`)
+	// the server holds the mutation until the test receives it
+	server.started = make(chan json.RawMessage)
+	defer server.Close()
+
+	sent := make(chan struct{})
+	var once sync.Once
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithLog(func(args ...interface{}) {
+			if message := fmt.Sprint(args...); strings.Contains(message, `"subscribe"`) && strings.Contains(message, "addUser") {
+				once.Do(func() { close(sent) })
+			}
+		})
+	defer client.Close()
+	go client.Run()
+
+	var m struct {
+		AddUser struct {
+			ID graphql.GqlString
+		} `graphql:"addUser(name: \"Ada\")"`
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.Mutate(context.Background(), &m, nil)
+	}()
+
+	<-sent
+	_ = client.Reset()
+	if got := string(<-server.started); !strings.Contains(got, "addUser") {
+		t.Fatalf("got payload %s, want the mutation", got)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, graphql.ErrConnectionReset) {
+			t.Errorf("got error: %v, want: %v", err, graphql.ErrConnectionReset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the mutation to fail")
+	}
+
+	// the mutation isn't sent again on the new connection, the next operation is
+	var q struct {
+		Viewer struct {
+			Login graphql.GqlString
+		}
+	}
+	go func() {
+		_ = client.Query(context.Background(), &q, nil)
+	}()
+	if got := string(<-server.started); got != `{"query":"{viewer{login}}"}` {
+		t.Errorf("got payload %s after reconnecting, want the query", got)
+	}
+}
+
+func TestSubscriptionClient_QueryRaw_errors(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"viewer":null},"errors":[{"message":"not logged in"}]}`)
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL()).WithLazyConnect(time.Minute)
+	defer client.Close()
+
+	var q struct {
+		Viewer struct {
+			Login graphql.GqlString
+		}
+	}
+	data, err := client.QueryRaw(context.Background(), &q, nil)
+	if err == nil || err.Error() != "not logged in" {
+		t.Errorf("got error: %v, want: not logged in", err)
+	}
+	if data == nil || string(*data) != `{"viewer":null}` {
+		t.Errorf("got data: %v, want partial data", data)
+	}
+}
+
+func TestSubscriptionHandle_OnRestart(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"event":{"id":1}}}`)
+	server.keepOpen = true
+	server.started = make(chan json.RawMessage, 2)
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL())
+	defer client.Close()
+
+	var sub struct {
+		Event struct {
+			ID graphql.GqlInt64
+		} `graphql:"event(since: $since)"`
+	}
+	var lastID int64
+	received := make(chan struct{}, 2)
+	handle, err := client.SubscribeIntoWithContext(context.Background(), sub, map[string]interface{}{"since": graphql.NewInt64Struct(0)}, func(data interface{}, err error) error {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		atomic.StoreInt64(&lastID, data.(*struct {
+			Event struct {
+				ID graphql.GqlInt64
+			} `graphql:"event(since: $since)"`
+		}).Event.ID.Int64)
+		received <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle.OnRestart(func(variables map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"since": graphql.NewInt64Struct(atomic.LoadInt64(&lastID))}
+	})
+	go client.Run()
+
+	<-received
+	if err := client.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	for _, want := range []string{`"variables":{"since":0}}`, `"variables":{"since":1}}`} {
+		select {
+		case got := <-server.started:
+			if !strings.HasSuffix(string(got), want) {
+				t.Errorf("got payload %s, want variables: %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for start message")
+		}
+	}
+}
+
+func TestSubscriptionHandle_OnRestart_queued(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"},
+		`{"data":{"event":{"id":1}}}`, `{"data":{"event":{"id":2}}}`, `{"data":{"event":{"id":3}}}`)
+	server.keepOpen = true
+	server.started = make(chan json.RawMessage, 2)
+	defer server.Close()
+
+	// the handler is held until the client reconnected, with the other messages still queued
+	release := make(chan struct{})
+	third := make(chan struct{})
+	var connections int32
+	var once sync.Once
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithLog(func(args ...interface{}) {
+			if strings.Contains(fmt.Sprint(args...), `"id":3`) {
+				once.Do(func() { close(third) })
+			}
+		}).
+		OnStateChange(func(change graphql.StateChange) {
+			if change.To == graphql.StateConnected && atomic.AddInt32(&connections, 1) == 2 {
+				close(release)
+			}
+		})
+	defer client.Close()
+
+	type event struct {
+		Event struct {
+			ID graphql.GqlInt64
+		} `graphql:"event(since: $since)"`
+	}
+	var lastID int64
+	handle, err := client.SubscribeIntoWithContext(context.Background(), event{}, map[string]interface{}{"since": graphql.NewInt64Struct(0)}, func(data interface{}, err error) error {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		id := data.(*event).Event.ID.Int64
+		if id == 1 && atomic.LoadInt64(&lastID) == 0 {
+			<-release
+		}
+		atomic.StoreInt64(&lastID, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle.OnRestart(func(variables map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"since": graphql.NewInt64Struct(atomic.LoadInt64(&lastID))}
+	})
+	go client.Run()
+
+	<-third
+	if err := client.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`"variables":{"since":0}}`, `"variables":{"since":3}}`} {
+		select {
+		case got := <-server.started:
+			if !strings.HasSuffix(string(got), want) {
+				t.Errorf("got payload %s, want variables: %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for start message")
+		}
+	}
+}
+
+func TestSubscriptionClient_variablesStruct(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"event":{"id":1}}}`)
+	server.keepOpen = true
+	server.started = make(chan json.RawMessage, 2)
+	defer server.Close()
+
+	client := graphql.NewSubscriptionClient(server.wsURL())
+	defer client.Close()
+
+	var sub struct {
+		Event struct {
+			ID graphql.GqlInt64
+		} `graphql:"event(since: $since)"`
+	}
+	variables := struct {
+		Since int `graphql:"since,type=Int!"`
+	}{}
+	received := make(chan struct{}, 2)
+	handle, err := client.SubscribeWithContext(context.Background(), sub, variables, func(data *json.RawMessage, err error) error {
+		received <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle.OnRestart(func(variables map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"since": variables["since"].(int) + 1}
+	})
+	go client.Run()
+
+	<-received
+	if err := client.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	for _, want := range []string{`"variables":{"since":0}}`, `"variables":{"since":1}}`} {
+		select {
+		case got := <-server.started:
+			if !strings.Contains(string(got), `subscription ($since:Int!)`) || !strings.HasSuffix(string(got), want) {
+				t.Errorf("got payload %s, want variables: %s declared as Int!", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for start message")
+		}
+	}
+}
+
+func TestSubscriptionClient_WithPrettyLog(t *testing.T) {
+	server := newSubscriptionServer(t, []string{"graphql-transport-ws"}, `{"data":{"viewer":{"login":"gopher"}}}`)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var logged []string
+	client := graphql.NewSubscriptionClient(server.wsURL()).
+		WithLog(func(args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			if s, ok := args[0].(string); ok {
+				logged = append(logged, s)
+			}
+		}).
+		WithPrettyLog()
+	defer client.Close()
+	go client.Run()
+
+	var q struct {
+		Viewer struct {
+			Login graphql.GqlString
+		} `graphql:"viewer(id: $id)"`
+	}
+	if err := client.Query(context.Background(), &q, map[string]interface{}{"id": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "query ($id: String!) {\n  viewer(id: $id) {\n    login\n  }\n}\nvariables: {\"id\":\"1\"}"
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range logged {
+		if strings.HasPrefix(s, "subscribe ") && strings.HasSuffix(s, want) {
+			return
+		}
+	}
+	t.Errorf("got log %q, want a subscribe message ending with %q", logged, want)
+}
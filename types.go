@@ -0,0 +1,161 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// GraphQLTyper is implemented by Go types that declare their GraphQL type name, e.g. custom scalars and enums.
+// It's used for variable definitions, and takes precedence over the Go type name.
+type GraphQLTyper interface {
+	GraphQLType() string
+}
+
+// typeRegistry holds the GraphQL type names of Go types registered with RegisterType.
+var typeRegistry sync.Map // map[reflect.Type]string
+
+func init() {
+	RegisterType(GqlBool{}, "Boolean")
+	RegisterType(GqlFloat64{}, "Float")
+	RegisterType(GqlInt64{}, "Int")
+	RegisterType(GqlString{}, "String")
+	RegisterType(GqlTime{}, "DateTime")
+	// Dgraph's input type of geo points
+	RegisterType(GqlPoint{}, "PointRef")
+}
+
+// RegisterType sets the GraphQL type name of the Go type of v, for types that can't implement GraphQLTyper.
+// E.g., RegisterType(uuid.UUID{}, "UUID").
+// A name ending with "!" declares a non-null type, even when passed by pointer.
+// Registering a type again replaces its name.
+func RegisterType(v interface{}, graphqlType string) {
+	typeRegistry.Store(reflect.TypeOf(v), graphqlType)
+}
+
+var graphqlTyperType = reflect.TypeOf((*GraphQLTyper)(nil)).Elem()
+
+// declaredTypeName returns the GraphQL type name of t if it's registered or implements GraphQLTyper.
+func declaredTypeName(t reflect.Type) (string, bool) {
+	if name, ok := typeRegistry.Load(t); ok {
+		return name.(string), true
+	}
+	if t.Implements(graphqlTyperType) {
+		return reflect.Zero(t).Interface().(GraphQLTyper).GraphQLType(), true
+	}
+	if reflect.PtrTo(t).Implements(graphqlTyperType) {
+		return reflect.New(t).Interface().(GraphQLTyper).GraphQLType(), true
+	}
+	return "", false
+}
+
+// graphqlTypeName returns the GraphQL type name of the named or builtin Go type t.
+//
+// It looks up, in order, the declared types, the Go type name, e.g. enums like "IssueState",
+// and the builtin kinds.
+func graphqlTypeName(t reflect.Type) (string, error) {
+	if name, ok := declaredTypeName(t); ok {
+		return name, nil
+	}
+	if t.PkgPath() != "" {
+		return t.Name(), nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "Boolean", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "Int", nil
+	case reflect.Float32, reflect.Float64:
+		return "Float", nil
+	case reflect.String:
+		return "String", nil
+	}
+	return "", unmappedTypeError(t)
+}
+
+func unmappedTypeError(t reflect.Type) error {
+	return fmt.Errorf("graphql: no GraphQL type for Go type %v, implement GraphQLTyper, call RegisterType or declare the variable type", t)
+}
+
+// Nullability of variable types, in queries, mutations and subscriptions alike:
+// a Go value is non-null and a pointer is nullable, e.g. int -> "Int!" and *int -> "Int",
+// except for declared types ending with "!", which are always non-null.
+// NonNull and Nullable override the nullability of a variable, the outermost one if nested.
+
+// nullabilityMarker overrides the nullability of a variable value.
+type nullabilityMarker struct {
+	value   interface{}
+	nonNull bool
+}
+
+// unwrapMarkers returns the value of v without its nullability markers, and the outermost marker if any.
+func unwrapMarkers(v interface{}) (interface{}, nullabilityMarker, bool) {
+	marker, marked := v.(nullabilityMarker)
+	for m, ok := marker, marked; ok; m, ok = v.(nullabilityMarker) {
+		v = m.value
+	}
+	return v, marker, marked
+}
+
+// MarshalJSON encodes the value only.
+func (m nullabilityMarker) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.value)
+}
+
+// NonNull marks the variable value v as non-null. E.g., NonNull(&id) -> "ID!".
+func NonNull(v interface{}) interface{} {
+	return nullabilityMarker{value: v, nonNull: true}
+}
+
+// Nullable marks the variable value v as nullable. E.g., Nullable(10) -> "Int".
+func Nullable(v interface{}) interface{} {
+	return nullabilityMarker{value: v}
+}
+
+// validateType reports whether typ is a well-formed GraphQL type reference,
+// e.g. "Int", "[ID!]!", rejecting doubled "!" and unbalanced lists.
+func validateType(typ string) error {
+	rest, err := parseType(typ)
+	if err == nil && rest != "" {
+		err = fmt.Errorf("unexpected %q", rest)
+	}
+	if err != nil {
+		return fmt.Errorf("graphql: invalid variable type %q: %s", typ, err)
+	}
+	return nil
+}
+
+// parseType parses a type reference at the start of s, and returns the rest of s.
+func parseType(s string) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("missing type name")
+	}
+	if s[0] == '[' {
+		rest, err := parseType(s[1:])
+		if err != nil {
+			return "", err
+		}
+		if rest == "" || rest[0] != ']' {
+			return "", fmt.Errorf("missing \"]\"")
+		}
+		s = rest[1:]
+	} else {
+		i := 0
+		for i < len(s) && (s[i] == '_' || 'a' <= s[i] && s[i] <= 'z' || 'A' <= s[i] && s[i] <= 'Z' || i > 0 && '0' <= s[i] && s[i] <= '9') {
+			i++
+		}
+		if i == 0 {
+			return "", fmt.Errorf("invalid type name at %q", s)
+		}
+		s = s[i:]
+	}
+	if s != "" && s[0] == '!' {
+		s = s[1:]
+		if s != "" && s[0] == '!' {
+			return "", fmt.Errorf("doubled \"!\"")
+		}
+	}
+	return s, nil
+}
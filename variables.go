@@ -0,0 +1,136 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/machship-mm/go-graphql-client/ident"
+)
+
+// Variables of an operation are either a map[string]interface{}, whose GraphQL types are derived
+// from the Go types of the values, or a struct whose fields declare the variable names and types in tags.
+// Untagged fields use the lowerCamel field name, and the field tagged "-" is ignored.
+//
+// E.g.,
+//
+//	struct {
+//		ID    string `graphql:"id,type=ID!"`
+//		First *int   `graphql:"first,type=Int"`
+//	}
+//
+// -> "$first:Int$id:ID!" and {"id": "...", "first": ...}.
+//
+// The "nonnull" and "nullable" options override the nullability of the Go type, e.g. `graphql:"first,nullable"`.
+
+// typedVariable is the value of a variable with an explicit GraphQL type.
+type typedVariable struct {
+	graphqlType string
+	value       interface{}
+}
+
+// MarshalJSON encodes the value only.
+func (v typedVariable) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.value)
+}
+
+// variablesMap converts variables, a map or a variables struct, to a map.
+func variablesMap(variables interface{}) (map[string]interface{}, error) {
+	switch vars := variables.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return vars, nil
+	}
+
+	v := reflect.ValueOf(variables)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("graphql: variables must be a map[string]interface{} or a struct, got %T", variables)
+	}
+
+	t := v.Type()
+	m := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		tag, ok := f.Tag.Lookup("graphql")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, options = tag[:i], tag[i+1:]
+		}
+		if !ok || name == "" {
+			name = ident.ParseMixedCaps(f.Name).ToLowerCamelCase()
+		}
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("graphql: variable %q is declared by more than one field of %v", name, t)
+		}
+
+		var value interface{} = v.Field(i).Interface()
+		var marker *nullabilityMarker
+		for _, option := range strings.Split(options, ",") {
+			switch {
+			case strings.HasPrefix(option, "type="):
+				value = typedVariable{graphqlType: strings.TrimPrefix(option, "type="), value: value}
+			case option == "nonnull":
+				marker = &nullabilityMarker{nonNull: true}
+			case option == "nullable":
+				marker = &nullabilityMarker{}
+			}
+		}
+		if marker != nil {
+			marker.value = value
+			value = *marker
+		}
+		m[name] = value
+	}
+	return m, nil
+}
+
+// variableValues returns the variables with the values of typed and marked variables unwrapped.
+func variableValues(variables map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(variables))
+	for k, v := range variables {
+		v, _, _ = unwrapMarkers(v)
+		if tv, ok := v.(typedVariable); ok {
+			v = tv.value
+		}
+		values[k] = v
+	}
+	return values
+}
+
+// withVariableTypes keeps the types of the typed and marked variables of previous for the same variables of values.
+func withVariableTypes(values, previous map[string]interface{}) map[string]interface{} {
+	variables := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if isDeclaredVariable(previous[k]) && !isDeclaredVariable(v) {
+			if typ, err := variableType(previous[k]); err == nil {
+				v = typedVariable{graphqlType: typ, value: v}
+			}
+		}
+		variables[k] = v
+	}
+	return variables
+}
+
+// isDeclaredVariable reports whether the type of the variable value v is declared rather than derived from its Go type.
+func isDeclaredVariable(v interface{}) bool {
+	switch v.(type) {
+	case typedVariable, nullabilityMarker:
+		return true
+	}
+	return false
+}